@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func isZipFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".zip"
+}
+
+func isTarFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".tar" || isTarGzFile(path)
+}
+
+func isTarGzFile(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, ".tar.gz") ||
+		strings.HasSuffix(lower, ".tgz")
+}
+
+func isArchiveFile(path string) bool {
+	return isZipFile(path) || isTarFile(path)
+}
+
+// addArchiveEntries registers the image entries of the archive as inputs and
+// returns their names in the order of the archive.
+func (r *Resource) addArchiveEntries(path string) ([]string, error) {
+	if isZipFile(path) {
+		return r.addZipEntries(path)
+	}
+	return r.addTarEntries(path)
+}
+
+// isImage reports whether the data looks like an image in a supported format.
+func isImage(r io.Reader) bool {
+	_, _, err := image.DecodeConfig(r)
+	return err == nil
+}
+
+// addZipEntries registers the image entries of the ZIP archive as inputs and
+// returns their names in the order of the archive.  Each entry is named like
+// "album.zip/path/to/entry.jpg".
+func (r *Resource) addZipEntries(path string) ([]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r.closers = append(r.closers, zr)
+
+	names := []string{}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		name := filepath.Join(path, filepath.FromSlash(zf.Name))
+		if zf.UncompressedSize64 > math.MaxInt64 || isLargeFile(
+			name, int64(zf.UncompressedSize64), r.Option) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		ok := isImage(rc)
+		rc.Close()
+		if !ok {
+			continue
+		}
+		r.addInput(name, zf.Open)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addTarEntries registers the image entries of the tar archive (optionally
+// gzipped) as inputs and returns their names in the order of the archive.
+// Since tar archives can only be read sequentially, the entries are read into
+// memory here.
+func (r *Resource) addTarEntries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if isTarGzFile(path) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	names := []string{}
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Large entries are skipped without being read.
+		name := filepath.Join(path, filepath.FromSlash(hdr.Name))
+		if isLargeFile(name, hdr.Size, r.Option) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if !isImage(bytes.NewReader(data)) {
+			continue
+		}
+		r.addInputBytes(name, data)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addInput registers an input which is not a file on disk.
+func (r *Resource) addInput(name string, open func() (io.ReadCloser, error)) {
+	if r.openers == nil {
+		r.openers = map[string]func() (io.ReadCloser, error){}
+	}
+	r.openers[name] = open
+}
+
+// addInputBytes registers an input whose content is already in memory.
+func (r *Resource) addInputBytes(name string, data []byte) {
+	r.addInput(name, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// isVirtualInput reports whether the input is not a file on disk, such as an
+// entry of an archive.
+func (r *Resource) isVirtualInput(name string) bool {
+	_, ok := r.openers[name]
+	return ok
+}
+
+// openInput opens the input file, which may be an entry of an archive.
+func (r *Resource) openInput(name string) (io.ReadCloser, error) {
+	if open, ok := r.openers[name]; ok {
+		return open()
+	}
+	return os.Open(name)
+}
+
+// closeInputs releases the archives opened for reading inputs.
+func (r *Resource) closeInputs() {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	r.closers = nil
+}
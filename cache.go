@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// imageMeta is the metadata of an image file kept in the cache file.  It's
+// valid while the size and the modification time of the file are unchanged.
+type imageMeta struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // in nanoseconds
+	Type    string `json:"type"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+// metaCache caches the metadata of image files across runs with --cache.
+// A nil *metaCache caches nothing.
+type metaCache struct {
+	file    string
+	entries map[string]imageMeta
+
+	// Entries of the files used in this run, which are saved.
+	mu   sync.Mutex
+	used map[string]imageMeta
+}
+
+// loadMetaCache reads the cache file.  A missing or broken cache file gives
+// an empty cache.
+func loadMetaCache(file string) *metaCache {
+	c := &metaCache{
+		file:    file,
+		entries: map[string]imageMeta{},
+		used:    map[string]imageMeta{},
+	}
+	if content, err := os.ReadFile(file); err == nil {
+		if json.Unmarshal(content, &c.entries) != nil {
+			c.entries = map[string]imageMeta{}
+		}
+	}
+	return c
+}
+
+// get returns the metadata of the file if it's cached and the file is not
+// changed since then.
+func (c *metaCache) get(file string) (imageMeta, bool) {
+	if c == nil {
+		return imageMeta{}, false
+	}
+	m, ok := c.entries[file]
+	if !ok {
+		return imageMeta{}, false
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Size() != m.Size ||
+		info.ModTime().UnixNano() != m.ModTime {
+		return imageMeta{}, false
+	}
+	c.mu.Lock()
+	c.used[file] = m
+	c.mu.Unlock()
+	return m, true
+}
+
+// put caches the metadata of the file.
+func (c *metaCache) put(file string, imgtype string, width, height int) {
+	if c == nil {
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.used[file] = imageMeta{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Type:    imgtype,
+		Width:   width,
+		Height:  height,
+	}
+	c.mu.Unlock()
+}
+
+// save writes the entries of the files used in this run to the cache file.
+// Entries of the other files are dropped.
+func (c *metaCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, err := json.Marshal(c.used)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.file, content, 0644)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// How to color the output: "auto", "always" or "never".  This is a global
+// since errors are printed also before and after building the PDF.
+var colorMode = "auto"
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+func parseColorMode(v string) (string, error) {
+	switch v {
+	case "auto", "always", "never":
+		return v, nil
+	}
+	return "", errors.New("Invalid color mode: " + v)
+}
+
+// colorEnabled reports whether the output to f is colored.  In auto mode,
+// it's colored only when f is a terminal and NO_COLOR is not set.
+func colorEnabled(f *os.File) bool {
+	switch colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize returns s colored with color when the output to f is colored.
+func colorize(f *os.File, color, s string) string {
+	if !colorEnabled(f) {
+		return s
+	}
+	return color + s + colorReset
+}
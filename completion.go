@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// The "completion" subcommand prints a completion script for the shell.  It's
+// not listed in the usage.  Load the script like:
+//
+//	bash: eval "$(gachanco completion bash)"
+//	zsh:  eval "$(gachanco completion zsh)"
+//	fish: gachanco completion fish | source
+
+func getCompletionUsage() string {
+	return strings.Join([]string{
+		"Usage: gachanco completion bash|zsh|fish",
+		"",
+		"    Print the completion script for the shell.  Load it like:",
+		"",
+		"    bash: eval \"$(gachanco completion bash)\"",
+		"    zsh:  eval \"$(gachanco completion zsh)\"",
+		"    fish: gachanco completion fish | source",
+	}, "\n")
+}
+
+func getCompletionScript(shell string) (string, error) {
+	names := []string{}
+	for _, f := range flagSpecs {
+		names = append(names, f.name)
+	}
+	flagList := strings.Join(names, " ")
+
+	switch shell {
+	case "bash":
+		return strings.Join([]string{
+			"_gachanco() {",
+			"    local cur=\"${COMP_WORDS[COMP_CWORD]}\"",
+			"    local words",
+			"    if [ \"$COMP_CWORD\" -eq 1 ]; then",
+			"        words=\"files dirs --help --version\"",
+			"        COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))",
+			"        return",
+			"    fi",
+			"    case \"$cur\" in",
+			"    -*)",
+			"        words=\"" + flagList + "\"",
+			"        COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))",
+			"        return",
+			"        ;;",
+			"    esac",
+			"    case \"${COMP_WORDS[1]}\" in",
+			"    dir|dirs) COMPREPLY=($(compgen -d -- \"$cur\")) ;;",
+			"    *) COMPREPLY=($(compgen -f -- \"$cur\")) ;;",
+			"    esac",
+			"}",
+			"complete -o filenames -F _gachanco gachanco",
+		}, "\n"), nil
+	case "zsh":
+		return strings.Join([]string{
+			"#compdef gachanco",
+			"_gachanco() {",
+			"    if (( CURRENT == 2 )); then",
+			"        compadd files dirs --help --version",
+			"        return",
+			"    fi",
+			"    if [[ $PREFIX == -* ]]; then",
+			"        compadd -- " + flagList,
+			"        return",
+			"    fi",
+			"    if [[ $words[2] == dir* ]]; then",
+			"        _files -/",
+			"    else",
+			"        _files",
+			"    fi",
+			"}",
+			"compdef _gachanco gachanco",
+		}, "\n"), nil
+	case "fish":
+		lines := []string{
+			"complete -c gachanco -f -n __fish_use_subcommand -a 'files dirs'",
+			"complete -c gachanco -n __fish_use_subcommand -s h -l help",
+			"complete -c gachanco -n __fish_use_subcommand -s V -l version",
+			"complete -c gachanco -n 'not __fish_use_subcommand' -F",
+		}
+		for _, f := range flagSpecs {
+			opt := "-l " + strings.TrimPrefix(f.name, "--")
+			if !strings.HasPrefix(f.name, "--") {
+				opt = "-s " + strings.TrimPrefix(f.name, "-")
+			}
+			if f.hasValue() {
+				opt += " -r"
+			}
+			lines = append(lines,
+				"complete -c gachanco -n 'not __fish_use_subcommand' "+opt)
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	return "", errors.New(
+		"Error: Unknown shell: " + shell + "\n" + getCompletionUsage())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The config file loaded when --config is not given.
+const defaultConfigFile = ".gachanco.toml"
+
+// defaultArgs returns the flags given by the config file and environment
+// variables, which are put before the command line flags so that the latter
+// take precedence.  Environment variables replace the values in the config
+// file, including false, which disables a flag enabled by the config file.
+func defaultArgs(configFile string) ([]string, error) {
+	values, err := configValues(configFile)
+	if err != nil {
+		return nil, err
+	}
+	envvalues, err := envValues()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range envvalues {
+		values[name] = value
+	}
+
+	args := []string{}
+	for _, f := range flagSpecs {
+		value, ok := values[f.name]
+		if !ok {
+			continue
+		}
+		if f.hasValue() {
+			args = append(args, f.name, value)
+		} else if value == "true" {
+			args = append(args, f.name)
+		}
+	}
+	return args, nil
+}
+
+// configValues returns the values of the flags given by the config file,
+// keyed by the flag names.  The value of a flag which doesn't take a value is
+// "true" or "false".  Each key of the config file is a flag name without the
+// leading "--", e.g.:
+//
+//	page-size = "150x100"
+//	overwrite-pdf = true
+//	jpeg-quality = 80
+//
+// "_" in keys may be used instead of "-".  When path is empty, the default
+// config file is loaded if it exists.
+func configValues(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			return values, nil
+		}
+		path = defaultConfigFile
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseTOML(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+
+	for _, e := range entries {
+		name := "--" + strings.ReplaceAll(e.key, "_", "-")
+		f, ok := lookupFlag(name)
+		if !ok || name == "--config" {
+			return nil, fmt.Errorf(
+				"%s:%d: Unknown key: %s", path, e.line, e.key)
+		}
+		if f.hasValue() {
+			if e.isBool {
+				return nil, fmt.Errorf(
+					"%s:%d: A value is needed for: %s", path, e.line, e.key)
+			}
+		} else if !e.isBool {
+			return nil, fmt.Errorf(
+				"%s:%d: true or false is needed for: %s", path, e.line, e.key)
+		}
+		values[f.name] = e.value
+	}
+	return values, nil
+}
+
+type tomlEntry struct {
+	key    string
+	value  string
+	isBool bool
+	line   int
+}
+
+// parseTOML parses the subset of TOML used for config files: top-level
+// key/value pairs whose values are strings, numbers or booleans, and
+// comments.
+func parseTOML(content string) ([]tomlEntry, error) {
+	entries := []tomlEntry{}
+	for i, line := range strings.Split(content, "\n") {
+		lnum := i + 1
+		malformed := func(msg string) error {
+			return fmt.Errorf("%d: Malformed TOML: %s", lnum, msg)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		} else if strings.HasPrefix(line, "[") {
+			return nil, malformed("Tables are not supported")
+		}
+
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, malformed("\"=\" is missing")
+		}
+		key = strings.TrimSpace(key)
+		if key == "" || strings.ContainsAny(key, " \t\"'.") {
+			return nil, malformed("Invalid key: " + key)
+		}
+		value, isBool, err := parseTOMLValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, malformed(err.Error())
+		}
+		entries = append(entries, tomlEntry{
+			key: key, value: value, isBool: isBool, line: lnum,
+		})
+	}
+	return entries, nil
+}
+
+// parseTOMLValue parses the value part of a key/value pair, which may be
+// followed by a comment.
+func parseTOMLValue(s string) (string, bool, error) {
+	trailing := func(rest string) error {
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return errors.New("Unexpected text after value: " + rest)
+		}
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(s, "\""):
+		// Basic string.  Find the closing quote skipping escapes.
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", false, errors.New("Unterminated string")
+		}
+		value, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", false, errors.New("Invalid string: " + s[:end+1])
+		}
+		return value, false, trailing(s[end+1:])
+	case strings.HasPrefix(s, "'"):
+		// Literal string.
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", false, errors.New("Unterminated string")
+		}
+		return s[1 : end+1], false, trailing(s[end+2:])
+	}
+
+	// Boolean or number.
+	value, _, _ := strings.Cut(s, "#")
+	value = strings.TrimSpace(value)
+	if value == "true" || value == "false" {
+		return value, true, nil
+	}
+	value = strings.ReplaceAll(value, "_", "")
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", false, errors.New("Invalid value: " + value)
+	}
+	return value, false, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// The resolution assumed for images which don't record their DPI.
+const defaultImageDPI = 72
+
+// readImageDPI reads the horizontal and vertical resolution recorded in the
+// image.  Only the JFIF header of JPEG and the pHYs chunk of PNG are
+// supported.  ok is false when the image doesn't record its resolution.
+func readImageDPI(src io.Reader, imgtype string) (x, y float64, ok bool) {
+	r := bufio.NewReader(src)
+	switch imgtype {
+	case "jpeg":
+		return readJPEGDPI(r)
+	case "png":
+		return readPNGDPI(r)
+	}
+	return 0, 0, false
+}
+
+func readJPEGDPI(r *bufio.Reader) (float64, float64, bool) {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil ||
+		!bytes.Equal(soi, []byte{0xff, 0xd8}) {
+		return 0, 0, false
+	}
+	// The JFIF APP0 segment comes just after SOI.
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil ||
+		header[0] != 0xff || header[1] != 0xe0 {
+		return 0, 0, false
+	}
+	size := int(binary.BigEndian.Uint16(header[2:]))
+	if size < 16 {
+		return 0, 0, false
+	}
+	app0 := make([]byte, size-2)
+	if _, err := io.ReadFull(r, app0); err != nil ||
+		!bytes.Equal(app0[:5], []byte("JFIF\x00")) {
+		return 0, 0, false
+	}
+	x := float64(binary.BigEndian.Uint16(app0[8:]))
+	y := float64(binary.BigEndian.Uint16(app0[10:]))
+	if x == 0 || y == 0 {
+		return 0, 0, false
+	}
+	switch app0[7] {
+	case 1: // dots per inch
+		return x, y, true
+	case 2: // dots per cm
+		return x * 2.54, y * 2.54, true
+	}
+	return 0, 0, false
+}
+
+func readPNGDPI(r *bufio.Reader) (float64, float64, bool) {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil ||
+		!bytes.Equal(signature, []byte("\x89PNG\r\n\x1a\n")) {
+		return 0, 0, false
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, 0, false
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "pHYs":
+			data := make([]byte, 9)
+			if size != 9 {
+				return 0, 0, false
+			} else if _, err := io.ReadFull(r, data); err != nil {
+				return 0, 0, false
+			}
+			x := float64(binary.BigEndian.Uint32(data[0:]))
+			y := float64(binary.BigEndian.Uint32(data[4:]))
+			if data[8] != 1 || x == 0 || y == 0 { // unit is not metre
+				return 0, 0, false
+			}
+			return x * 0.0254, y * 0.0254, true
+		case "IDAT", "IEND":
+			// pHYs must come before the image data.
+			return 0, 0, false
+		}
+		// Skip the chunk data and the CRC.
+		if _, err := r.Discard(int(size) + 4); err != nil {
+			return 0, 0, false
+		}
+	}
+}
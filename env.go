@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "GACHANCO_"
+
+// Environment variables which are not named after the flags.
+var envAliases = map[string]string{
+	"GACHANCO_OVERWRITE": "--overwrite-pdf",
+}
+
+// envValues returns the values of the flags given by environment variables,
+// keyed by the flag names.  A flag like "--page-size" is given by
+// GACHANCO_PAGE_SIZE.  Flags which don't take a value are given by a boolean
+// like "1" or "false", and their values are "true" or "false".  The variables
+// named after the flags take precedence over the aliases.
+func envValues() (map[string]string, error) {
+	type envFlag struct {
+		env  string
+		flag flagSpec
+	}
+	// Aliases come first so that they're overridden.
+	envs := []envFlag{}
+	for env, flag := range envAliases {
+		if f, ok := lookupFlag(flag); ok {
+			envs = append(envs, envFlag{env, f})
+		}
+	}
+	for _, f := range flagSpecs {
+		if !strings.HasPrefix(f.name, "--") {
+			continue
+		}
+		name := strings.TrimPrefix(f.name, "--")
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		envs = append(envs, envFlag{env, f})
+	}
+
+	values := map[string]string{}
+	for _, e := range envs {
+		value := os.Getenv(e.env)
+		if value == "" {
+			continue
+		}
+		if e.flag.hasValue() {
+			values[e.flag.name] = value
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New(
+				"Invalid value of environment variable: " +
+					e.env + "=" + value)
+		}
+		values[e.flag.name] = strconv.FormatBool(enabled)
+	}
+	return values, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+// flagSpec describes a flag.  The usage, the completion, and the flags given
+// by config files and environment variables are all made from flagSpecs, so
+// a flag is added here as well as to parseArgs.
+type flagSpec struct {
+	name string
+	// The placeholder of the value shown in the usage, e.g. "<file>".  Empty
+	// when the flag doesn't take a value.
+	value string
+	// The description of the flag, one line per element.  It's shared with
+	// the next flag when empty, e.g. --header and --footer.
+	help []string
+}
+
+func (f flagSpec) hasValue() bool {
+	return f.value != ""
+}
+
+var flagSpecs = []flagSpec{
+	{"-o", "<output file>", []string{
+		"Write the PDF to the file.  By default, the file is named",
+		"after the first target, e.g. \"images.pdf\" for \"images\".",
+	}},
+	{"--exclude-invalid-files", "", []string{
+		"Exclude non-valid image files in targets instead of",
+		"giving error.",
+	}},
+	{"--overwrite-pdf", "", []string{
+		"Overwrite PDF file even if it exists.",
+	}},
+	{"--no-mkdir", "", []string{
+		"Don't create the directory of the output file when it",
+		"doesn't exist.",
+	}},
+	{"--allow-empty", "", []string{
+		"Don't give error even if no files are found in the",
+		"specified dirs.",
+	}},
+	{"--cover-text", "<text>", []string{
+		"Add a cover page with the text at the beginning.",
+	}},
+	{"--cover-image", "<file>", []string{
+		"Add a cover page with the image at the beginning.",
+	}},
+	{"--page-size", "<width>x<height>", []string{
+		"Use the page size in mm (e.g. 150x100) instead of A4.",
+	}},
+	{"--border", "<width>[,#RRGGBB]", []string{
+		"Draw a border of the width in mm around each image.",
+		"The color is black by default.",
+	}},
+	{"--caption", "", []string{
+		"Put the file name under each image.",
+	}},
+	{"--caption-size", "<size>", []string{
+		"Font size of the captions in pt. (default: 10)",
+	}},
+	{"--header", "<text>", nil},
+	{"--footer", "<text>", []string{
+		"Put the text at the top/bottom of every page.  \"{page}\"",
+		"and \"{total}\" are replaced with the page number and the",
+		"total number of pages.",
+	}},
+	{"--crop", "", []string{
+		"Scale images to fill the page and crop the overflow instead",
+		"of leaving blank space.",
+	}},
+	{"--grayscale", "", []string{
+		"Convert images to grayscale.",
+	}},
+	{"--target-dpi", "<dpi>", []string{
+		"Downsample images which have more pixels than needed to",
+		"print them at the DPI.",
+	}},
+	{"--max-dimension", "<pixels>", []string{
+		"Downsample images whose width or height is larger than",
+		"<pixels>, keeping the aspect ratio.",
+	}},
+	{"--no-transcode", "", []string{
+		"Don't convert images in formats which can't be embedded",
+		"into PDF directly (BMP, TIFF and WebP).  Such images are",
+		"regarded as invalid.",
+	}},
+	{"--follow-symlinks", "", []string{
+		"Include symbolic links to files in dirs.  They are skipped",
+		"by default.",
+	}},
+	{"--max-file-size", "<size>", []string{
+		"Exclude files larger than the size (e.g. 500KB, 50MB, 1GB).",
+	}},
+	{"--include-hidden", "", []string{
+		"Include hidden files (dotfiles, Thumbs.db, etc.) in dirs.",
+	}},
+	{"--order", "<file>", []string{
+		"Order pages as listed in the file.  Each line is a file",
+		"name or a 1-based index of the input files.  Files not",
+		"listed are put at the end.",
+	}},
+	{"--order-strict", "", []string{
+		"Drop files not listed in the --order file.",
+	}},
+	{"--toc", "", []string{
+		"Add table of contents pages after the cover page.  Note",
+		"that all images are loaded before building pages.",
+	}},
+	{"--bookmarks", "", []string{
+		"Add a bookmark for each image.  In dirs mode, bookmarks",
+		"are grouped by directories.",
+	}},
+	{"--separator", "", []string{
+		"In dirs mode, put a blank page between the images from",
+		"different directories.",
+	}},
+	{"--separator-label", "", []string{
+		"Same as --separator, but the page shows the directory name.",
+	}},
+	{"--watermark", "<text>", []string{
+		"Put the text diagonally across every page.",
+	}},
+	{"--watermark-opacity", "<opacity>", []string{
+		"Opacity of the watermark from 0 to 1. (default: 0.3)",
+	}},
+	{"--watermark-angle", "<degrees>", []string{
+		"Angle of the watermark text. (default: 45)",
+	}},
+	{"--watermark-image", "<file>", []string{
+		"Put the image (e.g. a logo) on every page.",
+	}},
+	{"--watermark-pos", "<position>", []string{
+		"Position of the watermark image: top-left, top-right,",
+		"bottom-left, bottom-right or center.",
+		"(default: bottom-right)",
+	}},
+	{"--watermark-size", "<width>", []string{
+		"Width of the watermark image in mm. (default: 30)",
+	}},
+	{"--tile", "", []string{
+		"Repeat each image across the page in its physical size.",
+	}},
+	{"--tile-count", "<columns>x<rows>", []string{
+		"Repeat each image across the page in the grid.",
+	}},
+	{"--pixel-scale", "<scale>", []string{
+		"Make each page just as large as its image so that one",
+		"pixel is <scale> pt, ignoring DPI.  1 for 1:1.",
+	}},
+	{"--page-per-image", "", []string{
+		"Make each page just as large as its image at the DPI",
+		"recorded in the image, or 72 DPI if not recorded.",
+		"--pixel-scale takes precedence over this.",
+	}},
+	{"--spread", "", []string{
+		"Put two consecutive images side by side on a landscape",
+		"page, like facing pages of a book.  Each chapter starts",
+		"on the left half.  --pixel-scale and --page-per-image",
+		"are ignored.",
+	}},
+	{"--embed-originals", "", []string{
+		"Also attach the original image files to the PDF so that",
+		"they can be extracted as is.  The PDF gets larger by the",
+		"total size of the files, and about twice as large when",
+		"the images are embedded without conversion.",
+	}},
+	{"--max-output-size", "<size>", []string{
+		"Lower the JPEG quality until the PDF gets smaller than",
+		"the size (e.g. 10MB).  Only JPEG images and images",
+		"transcoded into JPEG get smaller.  When the PDF can't be",
+		"small enough, the smallest one is generated with a",
+		"warning.  The images are read only once, and the JPEG",
+		"images are kept decoded in memory while lowering the",
+		"quality.",
+	}},
+	{"--rotate-map", "<file>=<angle>[,<file>=<angle>...]", []string{
+		"Rotate the files clockwise by the angles, one of 90, 180",
+		"and 270.  A file is given by its path or its base name.",
+		"@<mapfile> reads the pairs from the file, one per line.",
+	}},
+	{"--retries", "<count>", []string{
+		"Retry reading a file up to <count> times on transient",
+		"errors like I/O timeouts, waiting longer each time.",
+		"Files are kept in memory until the PDF is written.",
+	}},
+	{"--merge-sort", "", []string{
+		"Sort the files in all the dirs together by name instead",
+		"of putting them dir by dir.  Dirs are no longer",
+		"regarded as chapters for --separator and --bookmarks.",
+	}},
+	{"--overrides", "<file>", []string{
+		"Override --crop, the alignment and the margin of each",
+		"file by the JSON file like:",
+		"    {\"a.jpg\": {\"fit\": \"crop\"},",
+		"     \"b.jpg\": {\"align\": \"top\", \"margin\": 10}}",
+		"fit is contain or crop.  align is center, top, bottom,",
+		"left, right, top-left, top-right, bottom-left or",
+		"bottom-right.  margin is in mm.  Files are given by their",
+		"paths or base names.",
+	}},
+	{"--trim", "", []string{
+		"Cut off the uniform border around each image, e.g. the",
+		"white margin of scans.  Images are decoded to detect it.",
+	}},
+	{"--trim-tolerance", "<tolerance>", []string{
+		"Regard colors which differ by at most <tolerance> (0-255)",
+		"per channel as uniform with --trim.  Default: 0",
+	}},
+	{"--best-fit-orientation", "", []string{
+		"Rotate the page of each image by 90 degrees when the",
+		"image fits the rotated page better, i.e. is shown larger",
+		"(or less cropped with --crop).  Ignored when the page",
+		"size is decided per image and with --spread.",
+	}},
+	{"--manifest", "<file>", []string{
+		"Write the source path, type, size in pixels, DPI and",
+		"placed size in mm of the image on each page to the file.",
+		"It's written in JSON if the file name ends with .json,",
+		"or in CSV otherwise.",
+	}},
+	{"--shuffle", "", []string{
+		"Put the pages in random order.  Dirs are no longer",
+		"regarded as chapters.  Can't be used with --order and",
+		"--merge-sort.",
+	}},
+	{"--seed", "<seed>", []string{
+		"Shuffle with the seed so that the same seed always gives",
+		"the same order.  Implies --shuffle.",
+	}},
+	{"--cache", "<file>", []string{
+		"Cache the types and the sizes of the images in the file to",
+		"skip reading them on the next run.  The cache of a file is",
+		"discarded when the file is modified.",
+	}},
+	{"--respect-dpi", "", []string{
+		"Put each image in its print size at the DPI recorded in",
+		"the image, or 72 DPI if not recorded, instead of fitting",
+		"it to the page.  Images larger than the page are still",
+		"scaled down.  Ignored with --crop.",
+	}},
+	{"--count", "", []string{
+		"Print the number of pages of the PDF and exit without",
+		"building it.  Images are not read, so invalid images are",
+		"counted as well.",
+	}},
+	{"--interactive", "", []string{
+		"Ask whether to overwrite, rename or abort when the output",
+		"file already exists.  Only works when stdin is a terminal.",
+	}},
+	{"--verbose", "", []string{
+		"Show detailed progress such as retries, and note animated",
+		"GIFs and multi-page TIFFs, of which only the first frame",
+		"or page is embedded.",
+	}},
+	{"--summary", "", []string{
+		"Show the statistics of the images and the output file size",
+		"after building.",
+	}},
+	{"--jpeg-quality", "<quality>", []string{
+		"Re-encode JPEG images with the quality from 1 to 100.",
+		"Lower quality makes the PDF smaller but the images",
+		"blockier.  Images are embedded as is by default.",
+	}},
+	{"--config", "<file>", []string{
+		"Load flags from the TOML file.  Keys are flag names",
+		"without \"--\", e.g. page-size = \"150x100\" or",
+		"overwrite-pdf = true.  .gachanco.toml in the current",
+		"directory is loaded when this flag is not given.",
+	}},
+	{"--color", "<auto|always|never>", []string{
+		"Color error and success messages.  auto, the default,",
+		"colors them only on a terminal unless NO_COLOR is set.",
+	}},
+	{"--no-color", "", []string{
+		"Same as --color never.",
+	}},
+}
+
+// lookupFlag returns the flag of the name, e.g. "--page-size".
+func lookupFlag(name string) (flagSpec, bool) {
+	for _, f := range flagSpecs {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return flagSpec{}, false
+}
+
+// flagUsage returns the lines of the usage describing the flags.
+func flagUsage() []string {
+	lines := []string{}
+	for _, f := range flagSpecs {
+		line := "    " + f.name
+		if f.hasValue() {
+			line += " " + f.value
+		}
+		lines = append(lines, line)
+		for _, h := range f.help {
+			lines = append(lines, "        "+h)
+		}
+	}
+	return lines
+}
@@ -2,4 +2,7 @@ module gachanco
 
 go 1.20
 
-require github.com/go-pdf/fpdf v0.8.0
+require (
+	github.com/go-pdf/fpdf v0.8.0
+	golang.org/x/image v0.18.0
+)
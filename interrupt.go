@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// The output file to remove when the build is interrupted.  The lock is held
+// while the PDF is written so that an interrupt never leaves a partially
+// written PDF nor removes a completed one.
+var pendingOutput struct {
+	sync.Mutex
+	file string
+}
+
+func setPendingOutput(file string) {
+	pendingOutput.Lock()
+	pendingOutput.file = file
+	pendingOutput.Unlock()
+}
+
+// handleInterrupt makes SIGINT and SIGTERM remove the pending output file
+// before exiting.
+func handleInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		pendingOutput.Lock()
+		if pendingOutput.file != "" {
+			os.Remove(pendingOutput.file)
+		}
+		fmt.Fprintln(os.Stderr, colorize(os.Stderr, colorRed, "Interrupted."))
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+}
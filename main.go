@@ -1,19 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/go-pdf/fpdf"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 const (
@@ -29,6 +43,63 @@ const (
 type BuildOption struct {
 	ExcludeInvalidFiles bool
 	OverwritePDF        bool
+	AllowEmpty          bool
+	CoverText           string
+	CoverImage          string
+	PageWidth           float64 // in mm
+	PageHeight          float64 // in mm
+	BorderWidth         float64 // in mm
+	BorderColor         [3]int  // RGB
+	Caption             bool
+	CaptionSize         float64 // in pt
+	Header              string
+	Footer              string
+	Crop                bool
+	Grayscale           bool
+	TargetDPI           float64
+	MaxDimension        int // in pixels
+	NoTranscode         bool
+	FollowSymlinks      bool
+	MaxFileSize         int64 // in bytes
+	IncludeHidden       bool
+	NoMkdir             bool
+	OrderFile           string
+	OrderStrict         bool
+	TOC                 bool
+	Bookmarks           bool
+	Separator           bool
+	SeparatorLabel      bool
+	Watermark           string
+	WatermarkOpacity    float64
+	WatermarkAngle      float64 // in degrees
+	WatermarkImage      string
+	WatermarkPos        string
+	WatermarkSize       float64 // in mm
+	Tile                bool
+	TileCols            int
+	TileRows            int
+	PixelScale          float64 // in pt per pixel
+	PagePerImage        bool
+	Spread              bool
+	EmbedOriginals      bool
+	MaxOutputSize       int64
+	RotateMap           map[string]int // file -> clockwise degrees
+	Retries             int
+	Verbose             bool
+	Interactive         bool
+	MergeSort           bool
+	Overrides           map[string]LayoutOverride
+	Trim                bool
+	TrimTolerance       int
+	BestFitOrientation  bool
+	Manifest            string
+	Shuffle             bool
+	Seed                int64
+	CacheFile           string
+	RespectDPI          bool
+	Count               bool
+	Summary             bool
+	JPEGQuality         int
 }
 
 type Resource struct {
@@ -36,22 +107,51 @@ type Resource struct {
 	Infiles     []string
 	InfilesKind int
 	Option      BuildOption
+
+	// True when Outfile is auto generated and created by
+	// generateOutputPDFName.
+	outfileClaimed bool
+
+	// Functions to open the inputs which are not files on disk, such as
+	// entries of archives.
+	openers map[string]func() (io.ReadCloser, error)
+
+	// Archives etc. to be closed after building PDF.
+	closers []io.Closer
+
+	// The directory where each input file is found in dirs mode.
+	chapters map[string]string
+
+	// The metadata cache with --cache.
+	cache *metaCache
 }
 
 func getUsage() string {
-	return strings.Join([]string{
+	lines := []string{
 		"Usage: gachanco files|dirs",
 		"        [<flags>] [-o <output file>] <target1> [,<target2>, [...]]",
+		"       gachanco --version",
 		"",
-		"    file(s)    Make PDF from specified files.",
+		"    file(s)    Make PDF from specified files.  Archives (.zip, .tar,",
+		"               .tar.gz, .tgz) are expanded and the images in them",
+		"               are used.",
+		"               HTTP(S) URLs can also be specified.",
 		"    dir(s)     Make PDF from images in specified directories.",
 		"",
 		"    <flags>",
-		"    --exclude-invalid-files",
-		"        Exclude non-valid image files in targets instead of",
-		"        giving error.",
-		"    --overwrite-pdf    Overwrite PDF file even if it exists.",
-	}, "\n")
+	}
+	lines = append(lines, flagUsage()...)
+	lines = append(lines,
+		"",
+		"    Environment variables",
+		"    Flags can also be given by environment variables named like",
+		"    GACHANCO_PAGE_SIZE for --page-size.  Set a value like \"1\" or",
+		"    \"true\" to enable flags which don't take a value.",
+		"    GACHANCO_OVERWRITE is the same as GACHANCO_OVERWRITE_PDF.",
+		"    Command line flags take precedence over environment variables,",
+		"    and environment variables take precedence over config files.",
+	)
+	return strings.Join(lines, "\n")
 }
 
 func hasInStrings(l []string, s string) bool {
@@ -63,35 +163,203 @@ func hasInStrings(l []string, s string) bool {
 	return false
 }
 
-func generateOutputPDFName(base string) string {
+// generateOutputPDFName returns a PDF file name based on "base" which doesn't
+// conflict with existing files.  The returned file is created (empty) here so
+// that other processes cannot take the name before the PDF is written.
+func generateOutputPDFName(base string) (string, error) {
 	// Convert "path/to/dir/" -> "path/to/dir"
 	if _, name := filepath.Split(base); name == "" {
 		base = filepath.Dir(base)
 	}
-	destPDFFile := base + ".pdf"
-	if _, err := os.Stat(destPDFFile); err == nil {
-		// destPDFFile is already exists. Add suffix.
-		tmp := base + "-" + time.Now().Format("20060102150405")
-		if _, err := os.Stat(tmp + ".pdf"); err == nil {
-			// It seems that we need much more suffix.
-			for i := 1; ; i++ {
-				s := fmt.Sprintf("-%03d", i)
-				if _, err := os.Stat(tmp + s + ".pdf"); err != nil {
-					tmp += s
-					break
-				}
+	claim := func(name string) (bool, error) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return false, nil
 			}
+			return false, err
+		}
+		return true, f.Close()
+	}
+
+	destPDFFile := base + ".pdf"
+	if ok, err := claim(destPDFFile); ok || err != nil {
+		return destPDFFile, err
+	}
+	// destPDFFile is already exists. Add suffix.
+	base += "-" + time.Now().Format("20060102150405")
+	destPDFFile = base + ".pdf"
+	if ok, err := claim(destPDFFile); ok || err != nil {
+		return destPDFFile, err
+	}
+	// It seems that we need much more suffix.
+	for i := 1; ; i++ {
+		destPDFFile = fmt.Sprintf("%s-%03d.pdf", base, i)
+		if ok, err := claim(destPDFFile); ok || err != nil {
+			return destPDFFile, err
+		}
+	}
+}
+
+// askCollision asks on the terminal what to do with the existing output file,
+// and returns "overwrite" or "rename".  An error is returned when aborted.
+func askCollision(outfile string) (string, error) {
+	fmt.Fprintln(os.Stderr, "Output file already exists:", outfile)
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "Overwrite / Rename / Abort? [o/r/a]: ")
+		line, err := r.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "o", "overwrite":
+			return "overwrite", nil
+		case "r", "rename":
+			return "rename", nil
+		case "a", "abort":
+			return "", errors.New("Aborted.")
+		}
+		if err != nil {
+			return "", errors.New("Aborted.")
+		}
+	}
+}
+
+// parsePageSize parses page size given like "150x100" (width x height in mm).
+func parsePageSize(s string) (float64, float64, error) {
+	invalid := errors.New("Invalid page size: " + s)
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, invalid
+	}
+	w, err := strconv.ParseFloat(ws, 64)
+	if err != nil || w <= 0 {
+		return 0, 0, invalid
+	}
+	h, err := strconv.ParseFloat(hs, 64)
+	if err != nil || h <= 0 {
+		return 0, 0, invalid
+	}
+	return w, h, nil
+}
+
+// parseBorder parses border spec given like "0.5" or "0.5,#RRGGBB".
+func parseBorder(s string) (float64, [3]int, error) {
+	invalid := errors.New("Invalid border: " + s)
+	color := [3]int{0, 0, 0}
+	ws, cs, hasColor := strings.Cut(s, ",")
+	w, err := strconv.ParseFloat(ws, 64)
+	if err != nil || w <= 0 {
+		return 0, color, invalid
+	}
+	if hasColor {
+		cs = strings.TrimPrefix(cs, "#")
+		rgb, err := strconv.ParseUint(cs, 16, 32)
+		if err != nil || len(cs) != 6 {
+			return 0, color, invalid
+		}
+		color = [3]int{
+			int(rgb >> 16 & 0xff), int(rgb >> 8 & 0xff), int(rgb & 0xff)}
+	}
+	return w, color, nil
+}
+
+// parseRotateMap parses the rotations given like "a.jpg=90,b.jpg=270".  When
+// the value is "@<file>", the rotations are read from the file, one per line.
+// Empty lines and lines starting with "#" in the file are ignored.
+func parseRotateMap(v string) (map[string]int, error) {
+	entries := strings.Split(v, ",")
+	if mapfile, ok := strings.CutPrefix(v, "@"); ok {
+		content, err := os.ReadFile(mapfile)
+		if err != nil {
+			return nil, err
+		}
+		entries = strings.Split(string(content), "\n")
+	}
+
+	rotations := map[string]int{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, errors.New("Invalid rotation: " + entry)
+		}
+		angle, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || angle%90 != 0 {
+			return nil, errors.New("Invalid rotation: " + entry)
 		}
-		destPDFFile = tmp + ".pdf"
+		rotations[strings.TrimSpace(entry[:i])] = (angle%360 + 360) % 360
+	}
+	return rotations, nil
+}
+
+// parseFileSize parses file size given like "500", "100KB", "50MB" or "2GB".
+func parseFileSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"B", 1},
+	}
+	num, unit := strings.ToUpper(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSuffix(num, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("Invalid file size: " + s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// parseGridSize parses grid size given like "3x4" (columns x rows).
+func parseGridSize(s string) (int, int, error) {
+	invalid := errors.New("Invalid grid size: " + s)
+	cs, rs, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, invalid
+	}
+	cols, err := strconv.Atoi(cs)
+	if err != nil || cols <= 0 {
+		return 0, 0, invalid
 	}
-	return destPDFFile
+	rows, err := strconv.Atoi(rs)
+	if err != nil || rows <= 0 {
+		return 0, 0, invalid
+	}
+	return cols, rows, nil
 }
 
+// errExit is returned by parseArgs when the program should exit successfully
+// without building PDF, e.g. after showing the usage.
+var errExit = errors.New("exit")
+
 func parseArgs(args []string) (Resource, error) {
 	arglen := len(args)
 	if arglen == 0 || hasInStrings([]string{"--help", "-h"}, args[0]) {
 		fmt.Println(getUsage())
-		return Resource{}, nil
+		return Resource{}, errExit
+	} else if hasInStrings([]string{"--version", "-V"}, args[0]) {
+		fmt.Println(getVersion())
+		return Resource{}, errExit
+	} else if args[0] == "completion" {
+		if arglen != 2 {
+			return Resource{}, errors.New(
+				"Error: Invalid argument\n" + getCompletionUsage())
+		}
+		script, err := getCompletionScript(args[1])
+		if err != nil {
+			return Resource{}, err
+		}
+		fmt.Println(script)
+		return Resource{}, errExit
 	} else if arglen == 1 ||
 		!hasInStrings([]string{"files", "file", "dirs", "dir"}, args[0]) {
 		errmsg := "Error: Invalid argument\n" + getUsage()
@@ -99,19 +367,369 @@ func parseArgs(args []string) (Resource, error) {
 	}
 
 	resource := Resource{}
+	resource.Option.WatermarkOpacity = 0.3
+	resource.Option.WatermarkAngle = 45
+	resource.Option.Seed = time.Now().UnixNano()
 
-	for i := 1; i < arglen; i++ {
-		if args[i] == "-o" {
+	// Flags from the config file and environment variables are overridden
+	// by the flags following them: command line > environment variables >
+	// config file.
+	configFile := os.Getenv(envPrefix + "CONFIG")
+	for i := 1; i < arglen-1; i++ {
+		if args[i] == "--config" {
+			configFile = args[i+1]
+		}
+		// Skip the value of the flag, e.g. "--header --config".
+		if f, ok := lookupFlag(args[i]); ok && f.hasValue() {
 			i++
-			if i == arglen {
-				return Resource{}, errors.New(
-					"Invalid argument: Nothing follows after \"-o\"")
+		}
+	}
+	defaultargs, err := defaultArgs(configFile)
+	if err != nil {
+		return Resource{}, err
+	}
+	args = append(append(args[:1:1], defaultargs...), args[1:]...)
+	arglen = len(args)
+
+	var i int
+	// Returns the argument that follows after the current flag.
+	nextArg := func() (string, error) {
+		flag := args[i]
+		i++
+		if i == arglen {
+			return "", errors.New(
+				"Invalid argument: Nothing follows after \"" + flag + "\"")
+		}
+		return args[i], nil
+	}
+
+	for i = 1; i < arglen; i++ {
+		if args[i] == "-o" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Outfile = v
+		} else if args[i] == "--cover-text" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.CoverText = v
+		} else if args[i] == "--cover-image" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.CoverImage = v
+		} else if args[i] == "--page-size" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			w, h, err := parsePageSize(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.PageWidth = w
+			resource.Option.PageHeight = h
+		} else if args[i] == "--border" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			w, color, err := parseBorder(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.BorderWidth = w
+			resource.Option.BorderColor = color
+		} else if args[i] == "--caption" {
+			resource.Option.Caption = true
+		} else if args[i] == "--caption-size" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			size, err := strconv.ParseFloat(v, 64)
+			if err != nil || size <= 0 {
+				return Resource{}, errors.New("Invalid caption size: " + v)
+			}
+			resource.Option.CaptionSize = size
+		} else if args[i] == "--header" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.Header = v
+		} else if args[i] == "--footer" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.Footer = v
+		} else if args[i] == "--crop" {
+			resource.Option.Crop = true
+		} else if args[i] == "--grayscale" {
+			resource.Option.Grayscale = true
+		} else if args[i] == "--target-dpi" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			dpi, err := strconv.ParseFloat(v, 64)
+			if err != nil || dpi <= 0 {
+				return Resource{}, errors.New("Invalid DPI: " + v)
+			}
+			resource.Option.TargetDPI = dpi
+		} else if args[i] == "--max-dimension" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return Resource{}, errors.New("Invalid dimension: " + v)
+			}
+			resource.Option.MaxDimension = n
+		} else if args[i] == "--no-transcode" {
+			resource.Option.NoTranscode = true
+		} else if args[i] == "--follow-symlinks" {
+			resource.Option.FollowSymlinks = true
+		} else if args[i] == "--max-file-size" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			size, err := parseFileSize(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.MaxFileSize = size
+		} else if args[i] == "--include-hidden" {
+			resource.Option.IncludeHidden = true
+		} else if args[i] == "--no-mkdir" {
+			resource.Option.NoMkdir = true
+		} else if args[i] == "--order" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.OrderFile = v
+		} else if args[i] == "--order-strict" {
+			resource.Option.OrderStrict = true
+		} else if args[i] == "--toc" {
+			resource.Option.TOC = true
+		} else if args[i] == "--bookmarks" {
+			resource.Option.Bookmarks = true
+		} else if args[i] == "--separator" {
+			resource.Option.Separator = true
+		} else if args[i] == "--separator-label" {
+			resource.Option.Separator = true
+			resource.Option.SeparatorLabel = true
+		} else if args[i] == "--watermark" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.Watermark = v
+		} else if args[i] == "--watermark-opacity" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			opacity, err := strconv.ParseFloat(v, 64)
+			if err != nil || opacity < 0 || opacity > 1 {
+				return Resource{}, errors.New("Invalid opacity: " + v)
+			}
+			resource.Option.WatermarkOpacity = opacity
+		} else if args[i] == "--watermark-angle" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			angle, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return Resource{}, errors.New("Invalid angle: " + v)
+			}
+			resource.Option.WatermarkAngle = angle
+		} else if args[i] == "--watermark-image" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.WatermarkImage = v
+		} else if args[i] == "--watermark-pos" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			if !hasInStrings(watermarkPositions, v) {
+				return Resource{}, errors.New("Invalid position: " + v)
+			}
+			resource.Option.WatermarkPos = v
+		} else if args[i] == "--watermark-size" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			size, err := strconv.ParseFloat(v, 64)
+			if err != nil || size <= 0 {
+				return Resource{}, errors.New("Invalid size: " + v)
+			}
+			resource.Option.WatermarkSize = size
+		} else if args[i] == "--tile" {
+			resource.Option.Tile = true
+		} else if args[i] == "--tile-count" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			cols, rows, err := parseGridSize(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.TileCols = cols
+			resource.Option.TileRows = rows
+		} else if args[i] == "--pixel-scale" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			scale, err := strconv.ParseFloat(v, 64)
+			if err != nil || scale <= 0 {
+				return Resource{}, errors.New("Invalid scale: " + v)
+			}
+			resource.Option.PixelScale = scale
+		} else if args[i] == "--page-per-image" {
+			resource.Option.PagePerImage = true
+		} else if args[i] == "--spread" {
+			resource.Option.Spread = true
+		} else if args[i] == "--embed-originals" {
+			resource.Option.EmbedOriginals = true
+		} else if args[i] == "--max-output-size" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			size, err := parseFileSize(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.MaxOutputSize = size
+		} else if args[i] == "--rotate-map" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			rotations, err := parseRotateMap(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.RotateMap = rotations
+		} else if args[i] == "--retries" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			retries, err := strconv.Atoi(v)
+			if err != nil || retries < 0 {
+				return Resource{}, errors.New("Invalid retry count: " + v)
+			}
+			resource.Option.Retries = retries
+		} else if args[i] == "--verbose" {
+			resource.Option.Verbose = true
+		} else if args[i] == "--interactive" {
+			resource.Option.Interactive = true
+		} else if args[i] == "--merge-sort" {
+			resource.Option.MergeSort = true
+		} else if args[i] == "--overrides" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			overrides, err := loadOverrides(v)
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.Overrides = overrides
+		} else if args[i] == "--trim" {
+			resource.Option.Trim = true
+		} else if args[i] == "--trim-tolerance" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			tolerance, err := strconv.Atoi(v)
+			if err != nil || tolerance < 0 || tolerance > 255 {
+				return Resource{}, errors.New("Invalid tolerance: " + v)
+			}
+			resource.Option.TrimTolerance = tolerance
+		} else if args[i] == "--best-fit-orientation" {
+			resource.Option.BestFitOrientation = true
+		} else if args[i] == "--manifest" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.Manifest = v
+		} else if args[i] == "--shuffle" {
+			resource.Option.Shuffle = true
+		} else if args[i] == "--seed" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			seed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return Resource{}, errors.New("Invalid seed: " + v)
+			}
+			resource.Option.Shuffle = true
+			resource.Option.Seed = seed
+		} else if args[i] == "--cache" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			resource.Option.CacheFile = v
+		} else if args[i] == "--respect-dpi" {
+			resource.Option.RespectDPI = true
+		} else if args[i] == "--count" {
+			resource.Option.Count = true
+		} else if args[i] == "--summary" {
+			resource.Option.Summary = true
+		} else if args[i] == "--jpeg-quality" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			quality, err := strconv.Atoi(v)
+			if err != nil || quality < 1 || quality > 100 {
+				return Resource{}, errors.New("Invalid JPEG quality: " + v)
+			}
+			resource.Option.JPEGQuality = quality
+		} else if args[i] == "--config" {
+			// Already loaded.
+			if _, err := nextArg(); err != nil {
+				return Resource{}, err
+			}
+		} else if args[i] == "--color" {
+			v, err := nextArg()
+			if err != nil {
+				return Resource{}, err
+			}
+			colorMode, err = parseColorMode(v)
+			if err != nil {
+				return Resource{}, err
 			}
-			resource.Outfile = args[i]
+		} else if args[i] == "--no-color" {
+			colorMode = "never"
 		} else if args[i] == "--exclude-invalid-files" {
 			resource.Option.ExcludeInvalidFiles = true
 		} else if args[i] == "--overwrite-pdf" {
 			resource.Option.OverwritePDF = true
+		} else if args[i] == "--allow-empty" {
+			resource.Option.AllowEmpty = true
 		} else {
 			resource.Infiles = append(resource.Infiles, args[i])
 		}
@@ -124,23 +742,239 @@ func parseArgs(args []string) (Resource, error) {
 	return resource, nil
 }
 
+// Files which OSes put in directories for their own use.  Compared in lower
+// case.
+var osMetadataFiles = []string{"thumbs.db", "desktop.ini"}
+
+// isHiddenFile reports whether the file should be regarded as a hidden file
+// in dirs mode.
+func isHiddenFile(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		hasInStrings(osMetadataFiles, strings.ToLower(name))
+}
+
+// excludeLargeFiles returns files whose size doesn't exceed the limit
+// specified by --max-file-size.
+func excludeLargeFiles(files []string, option BuildOption) []string {
+	if option.MaxFileSize <= 0 {
+		return files
+	}
+	result := []string{}
+	for _, fname := range files {
+		if info, err := os.Stat(fname); err == nil &&
+			isLargeFile(fname, info.Size(), option) {
+			continue
+		}
+		result = append(result, fname)
+	}
+	return result
+}
+
+// isLargeFile reports whether the size of the file exceeds the limit
+// specified by --max-file-size, and tells that the file is excluded if so.
+func isLargeFile(fname string, size int64, option BuildOption) bool {
+	if option.MaxFileSize <= 0 || size <= option.MaxFileSize {
+		return false
+	}
+	fmt.Println(
+		"File is larger than the limit:", size, "bytes\n",
+		"    Excluded:", fname)
+	return true
+}
+
+// applyOrderFile reorders files as listed in the order file.  Each line of
+// the order file is a file name (or a path) or a 1-based index of the files.
+// Empty lines and lines starting with "#" are ignored.  Files not listed are
+// put at the end, or dropped with --order-strict.
+func applyOrderFile(files []string, option BuildOption) ([]string, error) {
+	content, err := os.ReadFile(option.OrderFile)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make([]bool, len(files))
+	find := func(entry string) int {
+		if n, err := strconv.Atoi(entry); err == nil {
+			if n >= 1 && n <= len(files) && !used[n-1] {
+				return n - 1
+			}
+			return -1
+		}
+		for i, f := range files {
+			if !used[i] && (f == entry || filepath.Base(f) == entry) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	result := []string{}
+	notfound := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		entry := strings.TrimSpace(line)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := find(entry)
+		if i < 0 {
+			notfound = append(notfound, entry)
+			continue
+		}
+		used[i] = true
+		result = append(result, files[i])
+	}
+	if len(notfound) != 0 {
+		return nil, errors.New(
+			"Not found in the inputs:\n" + strings.Join(notfound, "\n"))
+	}
+
+	if !option.OrderStrict {
+		for i, f := range files {
+			if !used[i] {
+				result = append(result, f)
+			}
+		}
+	}
+	return result, nil
+}
+
+// scanDir lists the files in the directory to use as inputs, sorted by name.
+// Files are not filtered by their extensions; image formats are detected from
+// the content, so e.g. "IMAGE.JPG" is used as well as "image.jpg".
+func scanDir(dname string, option BuildOption) ([]string, error) {
+	entries, err := os.ReadDir(dname)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		// TODO: add check for non-image files
+		if !option.IncludeHidden && isHiddenFile(e.Name()) {
+			continue
+		}
+		path := filepath.Join(dname, e.Name())
+		if e.Type()&fs.ModeSymlink != 0 {
+			if !option.FollowSymlinks {
+				continue
+			}
+			// Skip links to directories, broken links and links which loop.
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+		} else if e.IsDir() {
+			continue
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// scanDirs lists the files in the directories concurrently, which is much
+// faster than one by one on network mounts.  The i-th list of the result is
+// the files in dirs[i].
+func scanDirs(dirs []string, option BuildOption) ([][]string, error) {
+	type result struct {
+		files []string
+		err   error
+	}
+	results := make([]chan result, len(dirs))
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, dname := range dirs {
+		results[i] = make(chan result, 1)
+		go func(dname string, dest chan<- result) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			files, err := scanDir(dname, option)
+			dest <- result{files: files, err: err}
+		}(dname, results[i])
+	}
+
+	lists := make([][]string, len(dirs))
+	for i, c := range results {
+		r := <-c
+		if r.err != nil {
+			return nil, r.err
+		}
+		lists[i] = r.files
+	}
+	return lists, nil
+}
+
 func validateResource(resource *Resource) error {
 	if len(resource.Infiles) == 0 {
 		return errors.New("Invalid argument: No files or dirs is specified.")
 	}
-
-	if resource.Outfile == "" {
-		resource.Outfile = generateOutputPDFName(resource.Infiles[0])
-		fmt.Println(
-			"No output file is specified. Auto generate output file:",
-			resource.Outfile)
-	} else if info, err := os.Stat(resource.Outfile); err == nil {
-		if info.IsDir() {
+	if resource.Option.Shuffle {
+		if resource.Option.OrderFile != "" {
 			return errors.New(
-				"Output file is a directory: " + resource.Outfile)
-		} else if !resource.Option.OverwritePDF {
+				"Invalid argument: --shuffle can't be used with --order")
+		} else if resource.Option.MergeSort {
 			return errors.New(
-				"Output file already exists: " + resource.Outfile)
+				"Invalid argument: --shuffle can't be used with --merge-sort")
+		}
+	}
+
+	if resource.Option.PageWidth == 0 || resource.Option.PageHeight == 0 {
+		resource.Option.PageWidth = A4WidthMM
+		resource.Option.PageHeight = A4HeightMM
+	}
+	if resource.Option.Spread &&
+		resource.Option.PageWidth < resource.Option.PageHeight {
+		resource.Option.PageWidth, resource.Option.PageHeight =
+			resource.Option.PageHeight, resource.Option.PageWidth
+	}
+	if resource.Option.CaptionSize == 0 {
+		resource.Option.CaptionSize = 10
+	}
+	if resource.Option.WatermarkPos == "" {
+		resource.Option.WatermarkPos = "bottom-right"
+	}
+	if resource.Option.WatermarkSize == 0 {
+		resource.Option.WatermarkSize = 30
+	}
+	if cover := resource.Option.CoverImage; cover != "" {
+		if _, err := loadExtraImage(cover, resource.Option); err != nil {
+			return fmt.Errorf("Invalid cover image: %s: %w", cover, err)
+		}
+	}
+	if wm := resource.Option.WatermarkImage; wm != "" {
+		if info, err := os.Stat(wm); err != nil || info.IsDir() {
+			return errors.New("Invalid watermark image: " + wm)
+		}
+		if _, err := loadExtraImage(wm, resource.Option); err != nil {
+			return fmt.Errorf("Invalid watermark image: %s: %w", wm, err)
+		}
+	}
+
+	// When no output file is specified, it's generated after all the other
+	// checks are passed.
+	outbase := resource.Infiles[0]
+	if isURL(outbase) {
+		outbase = urlBaseName(outbase)
+	}
+	// The output file is not touched when only counting pages.
+	renamed := false
+	if resource.Outfile != "" && !resource.Option.Count {
+		if info, err := os.Stat(resource.Outfile); err == nil {
+			if info.IsDir() {
+				return errors.New(
+					"Output file is a directory: " + resource.Outfile)
+			} else if !resource.Option.OverwritePDF {
+				if !resource.Option.Interactive || !isTerminal(os.Stdin) {
+					return errors.New(
+						"Output file already exists: " + resource.Outfile)
+				}
+				answer, err := askCollision(resource.Outfile)
+				if err != nil {
+					return err
+				}
+				if answer == "rename" {
+					// Generate the name like the auto generated ones.
+					outbase = strings.TrimSuffix(resource.Outfile, ".pdf")
+					resource.Outfile = ""
+					renamed = true
+				}
+			}
 		}
 	}
 
@@ -149,8 +983,29 @@ func validateResource(resource *Resource) error {
 		targetfiles := []string{}
 		// TODO: add check for non-image files
 		for _, fname := range resource.Infiles {
-			if info, err := os.Stat(fname); err == nil && !info.IsDir() {
+			if isURL(fname) {
+				data, err := fetchURL(fname, resource.Option)
+				if errors.Is(err, errLargeFile) {
+					continue
+				} else if err != nil {
+					fmt.Fprintln(os.Stderr,
+						colorize(os.Stderr, colorRed, err.Error()))
+					errfiles = append(errfiles, fname)
+					continue
+				}
+				resource.addInputBytes(fname, data)
 				targetfiles = append(targetfiles, fname)
+			} else if info, err := os.Stat(fname); err == nil && !info.IsDir() {
+				if !isArchiveFile(fname) {
+					targetfiles = append(targetfiles, fname)
+					continue
+				}
+				entries, err := resource.addArchiveEntries(fname)
+				if err != nil {
+					errfiles = append(errfiles, fname)
+					continue
+				}
+				targetfiles = append(targetfiles, entries...)
 			} else {
 				errfiles = append(errfiles, fname)
 			}
@@ -159,7 +1014,7 @@ func validateResource(resource *Resource) error {
 			return errors.New(
 				"Invalid files:\n" + strings.Join(errfiles, "\n"))
 		}
-		resource.Infiles = targetfiles
+		resource.Infiles = excludeLargeFiles(targetfiles, resource.Option)
 	} else {
 		errdirs := []string{}
 		targetdirs := []string{}
@@ -175,129 +1030,1413 @@ func validateResource(resource *Resource) error {
 				"Invalid dirs:\n" + strings.Join(errdirs, "\n"))
 		}
 
+		lists, err := scanDirs(targetdirs, resource.Option)
+		if err != nil {
+			return err
+		}
 		resource.Infiles = []string{}
-		for _, dname := range targetdirs {
-			entries, err := os.ReadDir(dname)
-			if err != nil {
-				return err
-			}
-			for _, e := range entries {
-				// TODO: add check for non-image files
-				if e.IsDir() {
-					continue
+		resource.chapters = map[string]string{}
+		// Pages are no longer grouped by dirs once they're reordered.
+		chaptered := !resource.Option.MergeSort &&
+			!resource.Option.Shuffle && resource.Option.OrderFile == ""
+		for i, dname := range targetdirs {
+			for _, path := range lists[i] {
+				resource.Infiles = append(resource.Infiles, path)
+				if chaptered {
+					resource.chapters[path] = dname
 				}
-				resource.Infiles =
-					append(resource.Infiles, filepath.Join(dname, e.Name()))
 			}
 		}
+		if resource.Option.MergeSort {
+			sort.SliceStable(resource.Infiles, func(i, j int) bool {
+				a, b := resource.Infiles[i], resource.Infiles[j]
+				if filepath.Base(a) != filepath.Base(b) {
+					return filepath.Base(a) < filepath.Base(b)
+				}
+				return a < b
+			})
+		}
+		resource.Infiles = excludeLargeFiles(resource.Infiles, resource.Option)
+		if len(resource.Infiles) == 0 && !resource.Option.AllowEmpty {
+			return errors.New(
+				"No files found in dirs:\n" + strings.Join(targetdirs, "\n"))
+		}
 		resource.InfilesKind = KindFile
 	}
-	return nil
-}
 
-func BuildPDF(resource Resource) error {
-	if err := validateResource(&resource); err != nil {
-		return err
+	if resource.Option.OrderFile != "" {
+		files, err := applyOrderFile(resource.Infiles, resource.Option)
+		if err != nil {
+			return err
+		}
+		resource.Infiles = files
 	}
-
-	type ImgOpt struct {
-		x float64
-		y float64
-		w float64
-		h float64
-		f string
-		t string
+	if resource.Option.Shuffle {
+		rnd := rand.New(rand.NewSource(resource.Option.Seed))
+		rnd.Shuffle(len(resource.Infiles), func(i, j int) {
+			resource.Infiles[i], resource.Infiles[j] =
+				resource.Infiles[j], resource.Infiles[i]
+		})
+		logVerbose(resource.Option, "Shuffled with seed %d\n",
+			resource.Option.Seed)
 	}
 
-	filesCount := len(resource.Infiles)
-	imgOpts := make([]ImgOpt, filesCount, filesCount)
-	errChan := make(chan error, filesCount)
-	var wg sync.WaitGroup
-	for i, file := range resource.Infiles {
-		wg.Add(1)
-		go func(file string, dest *ImgOpt) {
-			defer wg.Done()
-			f, err := os.Open(file)
-			if err != nil {
-				errChan <- err
-			}
-			c, imgtype, err := image.DecodeConfig(f)
-			if err != nil {
-				if resource.Option.ExcludeInvalidFiles {
-					fmt.Println(
-						"Error happens while extracting metadata:", err, "\n",
-						"    Excluded:", file)
-				} else {
-					errChan <- err
-				}
-				return
-			}
-
-			w, h := A4WidthMM, A4WidthMM
-			scaleX := A4WidthMM / float64(c.Width)
-			scaleY := A4HeightMM / float64(c.Height)
-
-			if scaleX < scaleY {
-				h = scaleX * float64(c.Height)
-			} else if scaleY < scaleX {
-				w = scaleY * float64(c.Width)
-			}
+	if resource.Option.Count {
+		return nil
+	}
+	if resource.Outfile != "" && !resource.Option.NoMkdir {
+		dir := filepath.Dir(resource.Outfile)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return fmt.Errorf("Failed to create output directory: %w", err)
+		}
+	}
+	if resource.Outfile == "" {
+		outfile, err := generateOutputPDFName(outbase)
+		if err != nil {
+			return err
+		}
+		resource.Outfile = outfile
+		resource.outfileClaimed = true
+		if renamed {
+			fmt.Println("Output file is renamed to:", resource.Outfile)
+		} else {
+			fmt.Println(
+				"No output file is specified. Auto generate output file:",
+				resource.Outfile)
+		}
+	}
+	return nil
+}
+
+type ImgOpt struct {
+	x float64
+	y float64
+	w float64
+	h float64
+	f string
+	t string
+
+	// Size of the image in pixels.  It's the size after trimming when the
+	// image is trimmed.
+	pw int
+	ph int
+
+	// DPI recorded in the image.  Zero when it's unknown or not read.
+	dpiX float64
+	dpiY float64
+
+	// The part of the image to embed with --trim.  Empty when the whole
+	// image is embedded.
+	trim image.Rectangle
+
+	// Size of the page for this image in mm.  Zero means the default page
+	// size.
+	pageW float64
+	pageH float64
+
+	// Clockwise rotation of the image in degrees; 0, 90, 180 or 270.
+	angle int
+
+	// How to fit the image to an area.  See fit().
+	crop   bool
+	align  string
+	margin float64
+
+	// The print size of a pixel in mm, horizontally and vertically in the
+	// source image, with --respect-dpi or --page-per-image.  The image keeps
+	// the aspect ratio of its print size and is not scaled up beyond it,
+	// unless they're zero.
+	mmPerPixelX float64
+	mmPerPixelY float64
+
+	// The area the image is fit to.
+	slot area
+
+	// The image is clipped to this area unless it's empty.
+	clip area
+
+	// Converted image data to embed instead of the file.  Nil when the file
+	// is embedded as is.
+	data []byte
+
+	// Content of the file to attach with --embed-originals.
+	original []byte
+
+	// True when the image is embedded in JPEG with --jpeg-quality, i.e. gets
+	// smaller with lower quality.
+	lossy bool
+}
+
+// fit computes where to place the image so that it fits the area leaving the
+// margin.  When crop is true, the image is scaled to fill the area instead
+// and the overflow is clipped.  Otherwise, the image is not scaled beyond
+// its print size if mmPerPixelX and mmPerPixelY are given.  The image is put
+// at the center of the area unless align is given.
+func (o *ImgOpt) fit(a area) {
+	if m := o.margin; m > 0 && 2*m < a.w && 2*m < a.h {
+		a = area{x: a.x + m, y: a.y + m, w: a.w - 2*m, h: a.h - 2*m}
+	}
+	pw, ph := o.displaySize()
+	w, h := float64(pw), float64(ph)
+	printSize := o.mmPerPixelX > 0 && o.mmPerPixelY > 0
+	if printSize {
+		mmX, mmY := o.mmPerPixelX, o.mmPerPixelY
+		if o.angle == 90 || o.angle == 270 {
+			mmX, mmY = mmY, mmX
+		}
+		w, h = w*mmX, h*mmY
+	}
+	scaleX := a.w / w
+	scaleY := a.h / h
+	scale := math.Min(scaleX, scaleY)
+	if o.crop {
+		scale = math.Max(scaleX, scaleY)
+	} else if printSize {
+		scale = math.Min(scale, 1)
+	}
+	o.w = scale * w
+	o.h = scale * h
+	o.x = a.x + (a.w-o.w)/2
+	o.y = a.y + (a.h-o.h)/2
+	if strings.Contains(o.align, "left") {
+		o.x = a.x
+	} else if strings.Contains(o.align, "right") {
+		o.x = a.x + a.w - o.w
+	}
+	if strings.Contains(o.align, "top") {
+		o.y = a.y
+	} else if strings.Contains(o.align, "bottom") {
+		o.y = a.y + a.h - o.h
+	}
+	o.slot = a
+	o.clip = area{}
+	if o.crop {
+		o.clip = a
+	}
+}
+
+// displaySize returns the size of the image in pixels as it's shown on the
+// page, i.e. after rotation.
+func (o ImgOpt) displaySize() (int, int) {
+	if o.angle == 90 || o.angle == 270 {
+		return o.ph, o.pw
+	}
+	return o.pw, o.ph
+}
+
+// fitScore rates how well the image fits the area: the size of the image
+// shown, or the ratio of the image shown when cropped.
+func (o ImgOpt) fitScore() float64 {
+	v := o.visibleArea()
+	if o.crop {
+		return v.w * v.h / (o.w * o.h)
+	}
+	return v.w * v.h
+}
+
+// visibleArea returns the area where the image is actually shown.
+func (o ImgOpt) visibleArea() area {
+	if o.clip != (area{}) {
+		return o.clip
+	}
+	return area{x: o.x, y: o.y, w: o.w, h: o.h}
+}
+
+// area represents a rectangle area on a page in mm.
+type area struct {
+	x float64
+	y float64
+	w float64
+	h float64
+}
+
+// imageArea returns the area of a page of pageW x pageH mm where an image can
+// be placed.
+func imageArea(option BuildOption, pageW, pageH float64) area {
+	a := area{x: 0, y: 0, w: pageW, h: pageH - bandsHeight(option)}
+	if option.Header != "" {
+		a.y += headerBandHeight
+	}
+	return a
+}
+
+// imageSlot returns the area of a page where an image is fit to.  In spread
+// mode, it's the left or right half of the image area.
+func imageSlot(option BuildOption, pageW, pageH float64, right bool) area {
+	a := imageArea(option, pageW, pageH)
+	if option.Spread {
+		a.w /= 2
+		if right {
+			a.x += a.w
+		}
+	}
+	return a
+}
+
+// bandsHeight returns the total height of the header, the footer and the
+// caption on a page.
+func bandsHeight(option BuildOption) float64 {
+	h := float64(0)
+	if option.Header != "" {
+		h += headerBandHeight
+	}
+	if option.Footer != "" {
+		h += headerBandHeight
+	}
+	if option.Caption {
+		h += captionBandHeight(option)
+	}
+	return h
+}
+
+// extractImgOpt reads the size of the image and computes where to place it
+// so that it fits the area.  When crop is true, the image is scaled to fill
+// the area instead and the overflow is clipped.
+func extractImgOpt(
+	src io.Reader, file string, a area, crop bool) (ImgOpt, error) {
+	c, imgtype, err := image.DecodeConfig(src)
+	if err != nil {
+		return ImgOpt{}, err
+	}
+	if c.Width == 0 || c.Height == 0 {
+		return ImgOpt{}, fmt.Errorf(
+			"Invalid image size: %dx%d", c.Width, c.Height)
+	}
+
+	o := ImgOpt{
+		t:  imgtype,
+		f:  file,
+		pw: c.Width,
+		ph: c.Height,
+	}
+	o.crop = crop
+	o.fit(a)
+	return o, nil
+}
+
+// Image types which fpdf can embed directly.  Images in other formats, i.e.
+// BMP, TIFF and WebP, are transcoded into PNG before being embedded.  Only the
+// first page of multi-page TIFFs is used.
+var embeddableImageTypes = []string{"jpeg", "png", "gif"}
+
+// needsConversion reports whether the image must be decoded and converted
+// before being embedded.
+func needsConversion(o ImgOpt, option BuildOption) bool {
+	if option.Grayscale || !o.trim.Empty() {
+		return true
+	}
+	if !option.NoTranscode && !hasInStrings(embeddableImageTypes, o.t) {
+		return true
+	}
+	if option.JPEGQuality > 0 && o.t == "jpeg" {
+		return true
+	}
+	_, _, ok := downsampleSize(o, option)
+	return ok
+}
+
+// downsampleSize returns the pixel size which is enough to show the image at
+// the target DPI and within the max dimension.  The last return value is
+// false when the image is not larger than that and doesn't need
+// downsampling.
+func downsampleSize(o ImgOpt, option BuildOption) (int, int, bool) {
+	scale := float64(1)
+	if option.TargetDPI > 0 {
+		needW := o.w / 25.4 * option.TargetDPI
+		needH := o.h / 25.4 * option.TargetDPI
+		pw, ph := o.displaySize()
+		if float64(pw) > needW || float64(ph) > needH {
+			scale = math.Max(needW/float64(pw), needH/float64(ph))
+		}
+	}
+	if option.MaxDimension > 0 {
+		longest := math.Max(float64(o.pw), float64(o.ph))
+		scale = math.Min(scale, float64(option.MaxDimension)/longest)
+	}
+	if scale >= 1 {
+		return 0, 0, false
+	}
+	w := int(math.Max(1, math.Ceil(scale*float64(o.pw))))
+	h := int(math.Max(1, math.Ceil(scale*float64(o.ph))))
+	if limit := option.MaxDimension; limit > 0 {
+		// Don't exceed the limit by rounding up.
+		if w > limit {
+			w = limit
+		}
+		if h > limit {
+			h = limit
+		}
+	}
+	return w, h, true
+}
+
+// convertImage decodes the image, applies the conversions specified by
+// the option and returns the encoded result with its image type.
+func convertImage(
+	src io.Reader, o ImgOpt, option BuildOption) ([]byte, string, error) {
+	img, imgtype, err := transformImage(src, o, option)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Images transcoded from formats fpdf doesn't support are also encoded
+	// in JPEG when the quality is specified.
+	quality := 95
+	if option.JPEGQuality > 0 {
+		quality = option.JPEGQuality
+		if !hasInStrings(embeddableImageTypes, imgtype) {
+			imgtype = "jpeg"
+		}
+	}
+	if imgtype != "jpeg" {
+		imgtype = "png"
+	}
+	data, err := encodeImage(img, imgtype, quality)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, imgtype, nil
+}
+
+// transformImage decodes the image and applies the conversions specified by
+// the option except encoding.
+func transformImage(
+	src io.Reader, o ImgOpt, option BuildOption) (image.Image, string, error) {
+	img, imgtype, err := image.Decode(src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !o.trim.Empty() {
+		img = cropImage(img, o.trim)
+	}
+	if w, h, ok := downsampleSize(o, option); ok {
+		img = resizeImage(img, w, h)
+	}
+	if option.Grayscale {
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+	return img, imgtype, nil
+}
+
+// encodeImage encodes the image in JPEG of the quality, or in PNG.
+func encodeImage(img image.Image, imgtype string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if imgtype == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeImage scales down the image to w x h pixels.  Each pixel of the
+// result is the average of the source pixels it covers.
+func resizeImage(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for i := 0; i < 4; i++ {
+						sum[i] += int(src.Pix[off+i])
+					}
+					off += 4
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			off := dst.PixOffset(x, y)
+			for i := 0; i < 4; i++ {
+				dst.Pix[off+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
 
-			x := (A4WidthMM - w) / 2
-			y := (A4HeightMM - h) / 2
+// rotationOf returns the rotation of the file given by --rotate-map.
+func rotationOf(file string, option BuildOption) int {
+	if angle, ok := option.RotateMap[file]; ok {
+		return angle
+	}
+	return option.RotateMap[filepath.Base(file)]
+}
+
+// loadImgOpt computes where to place the input image on a page, and
+// prepares the image data to embed if the input can't be embedded from disk
+// as is.
+func loadImgOpt(resource *Resource, file string) (ImgOpt, error) {
+	option := resource.Option
+	a := imageSlot(option, option.PageWidth, option.PageHeight, false)
+	var o ImgOpt
+	if m, ok := resource.cache.get(file); ok {
+		o = ImgOpt{t: m.Type, f: file, pw: m.Width, ph: m.Height}
+		o.crop = option.Crop
+		o.fit(a)
+	} else {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		o, err = extractImgOpt(src, file, a, option.Crop)
+		src.Close()
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		if !resource.isVirtualInput(file) {
+			resource.cache.put(file, o.t, o.pw, o.ph)
+		}
+	}
+	if option.NoTranscode && !hasInStrings(embeddableImageTypes, o.t) {
+		return ImgOpt{}, errors.New(
+			"Image needs transcoding to be embedded: " + o.t)
+	}
+	if option.Manifest != "" || option.RespectDPI || option.PagePerImage ||
+		option.Tile {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		o.dpiX, o.dpiY, _ = readImageDPI(src, o.t)
+		src.Close()
+	}
+	if option.Verbose && o.t == "gif" {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		if note := describeAnimation(src); note != "" {
+			logVerbose(option, "%s: %s\n", file, note)
+		}
+		src.Close()
+	} else if option.Verbose && o.t == "tiff" {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		if n := countTIFFPages(src); n > 1 {
+			logVerbose(option,
+				"%s: TIFF with %d pages.  Only the first page is embedded.\n",
+				file, n)
+		}
+		src.Close()
+	}
+	if option.Trim {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		img, _, err := image.Decode(src)
+		src.Close()
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		if r := trimBounds(img, option.TrimTolerance); r != img.Bounds() {
+			o.trim = r
+			o.pw, o.ph = r.Dx(), r.Dy()
+		}
+	}
+	if option.RespectDPI {
+		dpiX, dpiY := o.dpiX, o.dpiY
+		if dpiX == 0 || dpiY == 0 {
+			dpiX, dpiY = defaultImageDPI, defaultImageDPI
+		}
+		o.mmPerPixelX, o.mmPerPixelY = 25.4/dpiX, 25.4/dpiY
+	}
+	o.angle = rotationOf(file, option)
+	applyOverride(&o, file, option)
+	o.fit(a)
+
+	if (option.PixelScale > 0 || option.PagePerImage) && !option.Spread {
+		// Make the page just as large as the image.
+		o.mmPerPixelX = option.PixelScale * 25.4 / 72
+		o.mmPerPixelY = o.mmPerPixelX
+		if option.PixelScale == 0 {
+			dpiX, dpiY := o.dpiX, o.dpiY
+			if dpiX == 0 || dpiY == 0 {
+				dpiX, dpiY = defaultImageDPI, defaultImageDPI
+			}
+			o.mmPerPixelX, o.mmPerPixelY = 25.4/dpiX, 25.4/dpiY
+		}
+		pw, ph := o.displaySize()
+		mmX, mmY := o.mmPerPixelX, o.mmPerPixelY
+		if o.angle == 90 || o.angle == 270 {
+			mmX, mmY = mmY, mmX
+		}
+		o.pageW = float64(pw) * mmX
+		o.pageH = float64(ph)*mmY + bandsHeight(option)
+		o.fit(imageArea(option, o.pageW, o.pageH))
+	} else if option.BestFitOrientation && !option.Spread {
+		// Use the rotated page if the image fits it better.
+		unrotated := o
+		o.pageW, o.pageH = option.PageHeight, option.PageWidth
+		o.fit(imageArea(option, o.pageW, o.pageH))
+		if o.fitScore() <= unrotated.fitScore() {
+			o = unrotated
+		}
+	}
+
+	o.lossy = o.t == "jpeg" || !hasInStrings(embeddableImageTypes, o.t)
+	if needsConversion(o, option) || resource.isVirtualInput(file) {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		defer src.Close()
+		if needsConversion(o, option) {
+			o.data, o.t, err = convertImage(src, o, option)
+		} else {
+			o.data, err = io.ReadAll(src)
+			o.original = o.data
+		}
+		if err != nil {
+			return ImgOpt{}, err
+		}
+	}
+
+	if option.EmbedOriginals && o.original == nil {
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		defer src.Close()
+		if o.original, err = io.ReadAll(src); err != nil {
+			return ImgOpt{}, err
+		}
+	}
+	return o, nil
+}
+
+// describeAnimation returns a note on the animation of the GIF image, or an
+// empty string when it's not animated.
+func describeAnimation(src io.Reader) string {
+	g, err := gif.DecodeAll(src)
+	if err != nil || len(g.Image) <= 1 {
+		return ""
+	}
+	loop := "looping forever"
+	if g.LoopCount < 0 {
+		loop = "played once"
+	} else if g.LoopCount > 0 {
+		loop = fmt.Sprintf("played %d times", g.LoopCount+1)
+	}
+	return fmt.Sprintf(
+		"Animated GIF with %d frames, %s.  Only the first frame is embedded.",
+		len(g.Image), loop)
+}
+
+// countTIFFPages returns the number of pages, i.e. IFDs, of the TIFF image.
+// Broken IFDs are not counted.
+func countTIFFPages(src io.Reader) int {
+	data, err := io.ReadAll(src)
+	if err != nil || len(data) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	pages := 0
+	seen := map[uint32]bool{}
+	for off := order.Uint32(data[4:]); off != 0 && !seen[off]; pages++ {
+		seen[off] = true
+		// Number of entries (2 bytes), entries (12 bytes each) and the
+		// offset of the next IFD (4 bytes)
+		end := int64(off) + 2
+		if end > int64(len(data)) {
+			break
+		}
+		end += int64(order.Uint16(data[off:])) * 12
+		if end+4 > int64(len(data)) {
+			break
+		}
+		off = order.Uint32(data[end:])
+	}
+	return pages
+}
+
+func captionBandHeight(option BuildOption) float64 {
+	return option.CaptionSize * 25.4 / 72 * 1.5 // pt -> mm
+}
+
+// drawCaption renders the base name of the image file just below the image.
+func drawCaption(pdf *fpdf.Fpdf, o ImgOpt, option BuildOption) {
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetFont("Helvetica", "", option.CaptionSize)
+	pdf.SetXY(o.slot.x, o.visibleArea().y+o.visibleArea().h)
+	pdf.CellFormat(o.slot.w, captionBandHeight(option), tr(filepath.Base(o.f)),
+		"", 0, "C", false, 0, "")
+}
+
+const (
+	headerBandHeight = float64(10) // in mm
+	headerFontSize   = float64(9)  // in pt
+)
+
+// setHeaderFooter registers the header and the footer text to the pdf.
+func setHeaderFooter(pdf *fpdf.Fpdf, option BuildOption) {
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	draw := func(text string, y float64) {
+		text = strings.ReplaceAll(text, "{page}", strconv.Itoa(pdf.PageNo()))
+		pageW, _ := pdf.GetPageSize()
+		pdf.SetFont("Helvetica", "", headerFontSize)
+		pdf.SetXY(0, y)
+		pdf.CellFormat(pageW, headerBandHeight, tr(text), "", 0, "C",
+			false, 0, "")
+	}
+	if option.Header != "" {
+		pdf.SetHeaderFunc(func() {
+			draw(option.Header, 0)
+		})
+	}
+	// The watermark is drawn in the footer so that it's put on top of
+	// everything on every page.
+	var wm ImgOpt
+	if option.WatermarkImage != "" {
+		// The image is checked by validateResource().
+		wm, _ = loadExtraImage(option.WatermarkImage, option)
+	}
+	if option.Footer != "" || option.Watermark != "" || wm.t != "" {
+		pdf.SetFooterFunc(func() {
+			if option.Watermark != "" {
+				drawWatermark(pdf, tr(option.Watermark), option)
+			}
+			if wm.t != "" {
+				drawWatermarkImage(pdf, wm, option)
+			}
+			if option.Footer != "" {
+				_, pageH := pdf.GetPageSize()
+				draw(option.Footer, pageH-headerBandHeight)
+			}
+		})
+	}
+	pdf.AliasNbPages("{total}")
+}
 
-			*dest = ImgOpt{
-				x: x,
-				y: y,
+// Positions of the watermark image.
+var watermarkPositions = []string{
+	"top-left", "top-right", "bottom-left", "bottom-right", "center",
+}
+
+// drawWatermarkImage puts the watermark image loaded by loadExtraImage on the
+// current page.
+func drawWatermarkImage(pdf *fpdf.Fpdf, wm ImgOpt, option BuildOption) {
+	const margin = 10 // in mm
+	imgopt := fpdf.ImageOptions{ImageType: wm.t, ReadDpi: true}
+	name, info := registerImage(pdf, wm, imgopt)
+	if info == nil || info.Width() == 0 {
+		return // The error is reported on output.
+	}
+	pageW, pageH := pdf.GetPageSize()
+	w := option.WatermarkSize
+	h := w * info.Height() / info.Width()
+
+	x, y := (pageW-w)/2, (pageH-h)/2
+	pos := option.WatermarkPos
+	if strings.HasPrefix(pos, "top-") {
+		y = margin
+	} else if strings.HasPrefix(pos, "bottom-") {
+		y = pageH - margin - h
+	}
+	if strings.HasSuffix(pos, "-left") {
+		x = margin
+	} else if strings.HasSuffix(pos, "-right") {
+		x = pageW - margin - w
+	}
+
+	pdf.SetAlpha(option.WatermarkOpacity, "Normal")
+	pdf.ImageOptions(name, x, y, w, h, false, imgopt, 0, "")
+	pdf.SetAlpha(1, "Normal")
+}
+
+// drawWatermark draws the text across the center of the current page.
+func drawWatermark(pdf *fpdf.Fpdf, text string, option BuildOption) {
+	pageW, pageH := pdf.GetPageSize()
+	cx, cy := pageW/2, pageH/2
+
+	// Make the text as long as 70% of the diagonal of the page.
+	const baseSize = 100
+	pdf.SetFont("Helvetica", "B", baseSize)
+	fontSize := baseSize * math.Hypot(pageW, pageH) * 0.7 /
+		pdf.GetStringWidth(text)
+	pdf.SetFontSize(fontSize)
+	w := pdf.GetStringWidth(text)
+	h := fontSize * 25.4 / 72 // pt -> mm
+
+	pdf.TransformBegin()
+	pdf.TransformRotate(option.WatermarkAngle, cx, cy)
+	pdf.SetAlpha(option.WatermarkOpacity, "Normal")
+	pdf.SetTextColor(128, 128, 128)
+	pdf.Text(cx-w/2, cy+h/3, text)
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetAlpha(1, "Normal")
+	pdf.TransformEnd()
+}
+
+func addCoverPage(pdf *fpdf.Fpdf, option BuildOption) error {
+	pdf.AddPage()
+	if option.CoverImage != "" {
+		o, err := loadExtraImage(option.CoverImage, option)
+		if err != nil {
+			return fmt.Errorf("Cover image: %s: %w", option.CoverImage, err)
+		}
+		o.fit(area{x: 0, y: 0, w: option.PageWidth, h: option.PageHeight})
+		imgopt := fpdf.ImageOptions{
+			ImageType:             o.t,
+			ReadDpi:               true,
+			AllowNegativePosition: true,
+		}
+		name, _ := registerImage(pdf, o, imgopt)
+		pdf.ImageOptions(name, o.x, o.y, o.w, o.h, false, imgopt, 0, "")
+	}
+	if option.CoverText != "" {
+		const fontSize = 28
+		lineHeight := fontSize * 25.4 / 72 * 1.5 // pt -> mm
+		pageW, pageH := pdf.GetPageSize()
+		tr := pdf.UnicodeTranslatorFromDescriptor("")
+		pdf.SetFont("Helvetica", "B", fontSize)
+		pdf.SetXY(0, (pageH-lineHeight)/2)
+		pdf.CellFormat(pageW, lineHeight, tr(option.CoverText), "", 0, "C",
+			false, 0, "")
+	}
+	return nil
+}
+
+// addSeparatorPage adds a page put between the images from different
+// directories.  The page shows the directory name with --separator-label.
+func addSeparatorPage(pdf *fpdf.Fpdf, dir string, option BuildOption) {
+	pdf.AddPage()
+	if !option.SeparatorLabel {
+		return
+	}
+	const fontSize = 20
+	lineHeight := fontSize * 25.4 / 72 * 1.5 // pt -> mm
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pageW, pageH := pdf.GetPageSize()
+	pdf.SetFont("Helvetica", "B", fontSize)
+	pdf.SetXY(0, (pageH-lineHeight)/2)
+	pdf.CellFormat(pageW, lineHeight, tr(dir), "", 0, "C", false, 0, "")
+}
+
+// addImagePage adds a new page and puts the image on it.
+func addImagePage(pdf *fpdf.Fpdf, o ImgOpt, option BuildOption) {
+	if o.pageW > 0 && o.pageH > 0 {
+		pdf.AddPageFormat("P", fpdf.SizeType{Wd: o.pageW, Ht: o.pageH})
+	} else {
+		pdf.AddPage()
+	}
+	drawImage(pdf, o, option)
+}
+
+// imageName returns the name to register the image with fpdf, which caches
+// images by name.  Images given as data are named after their content so that
+// they're not mistaken for the file registered by its path, e.g. the same file
+// given by --cover-image, which would be embedded without conversion.
+func imageName(o ImgOpt) string {
+	if o.data == nil {
+		return o.f
+	}
+	return fmt.Sprintf("%s#%x", o.f, sha256.Sum256(o.data))
+}
+
+// registerImage registers the image with fpdf, and returns the name to put
+// it by with its info.
+func registerImage(pdf *fpdf.Fpdf, o ImgOpt,
+	imgopt fpdf.ImageOptions) (string, *fpdf.ImageInfoType) {
+	name := imageName(o)
+	if o.data != nil {
+		return name, pdf.RegisterImageOptionsReader(
+			name, imgopt, bytes.NewReader(o.data))
+	}
+	return name, pdf.RegisterImageOptions(name, imgopt)
+}
+
+// loadExtraImage reads the image given by a flag like --cover-image rather
+// than as a page.  Images fpdf can't embed are transcoded into PNG unless
+// --no-transcode is given.
+func loadExtraImage(file string, option BuildOption) (ImgOpt, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ImgOpt{}, err
+	}
+	defer f.Close()
+	o, err := extractImgOpt(f, file, area{}, false)
+	if err != nil || hasInStrings(embeddableImageTypes, o.t) {
+		return o, err
+	}
+	if option.NoTranscode {
+		return ImgOpt{}, errors.New(
+			"Image needs transcoding to be embedded: " + o.t)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ImgOpt{}, err
+	}
+	// Only transcode it; the other conversions are for the pages.
+	o.data, o.t, err = convertImage(f, o, BuildOption{})
+	return o, err
+}
+
+// drawImage puts the image on the current page.
+func drawImage(pdf *fpdf.Fpdf, o ImgOpt, option BuildOption) {
+	clipped := o.clip != (area{})
+	if clipped {
+		pdf.ClipRect(o.clip.x, o.clip.y, o.clip.w, o.clip.h, false)
+	}
+	// Positions are always given explicitly.  Don't let fpdf regard
+	// (slightly) negative positions as "the current position".
+	imgopt := fpdf.ImageOptions{
+		ImageType:             o.t,
+		ReadDpi:               true,
+		AllowNegativePosition: true,
+	}
+	name, _ := registerImage(pdf, o, imgopt)
+
+	tiles := []area{{x: o.x, y: o.y, w: o.w, h: o.h}}
+	if isTileMode(option) {
+		tiles = tileAreas(o, o.slot, option)
+		// Regard the whole tiles as the image for the caption.
+		first, last := tiles[0], tiles[len(tiles)-1]
+		o.x, o.y = first.x, first.y
+		o.w, o.h = last.x+last.w-first.x, last.y+last.h-first.y
+	}
+	for _, t := range tiles {
+		if o.angle == 0 {
+			pdf.ImageOptions(name, t.x, t.y, t.w, t.h, false, imgopt, 0, "")
+			continue
+		}
+		// Put the image unrotated at the center of the area, and rotate it
+		// around the center.  fpdf rotates counter-clockwise.
+		w, h := t.w, t.h
+		if o.angle == 90 || o.angle == 270 {
+			w, h = h, w
+		}
+		cx, cy := t.x+t.w/2, t.y+t.h/2
+		pdf.TransformBegin()
+		pdf.TransformRotate(-float64(o.angle), cx, cy)
+		pdf.ImageOptions(name, cx-w/2, cy-h/2, w, h, false, imgopt, 0, "")
+		pdf.TransformEnd()
+	}
+	if clipped {
+		pdf.ClipEnd()
+	}
+	if option.BorderWidth > 0 {
+		c := option.BorderColor
+		pdf.SetDrawColor(c[0], c[1], c[2])
+		pdf.SetLineWidth(option.BorderWidth)
+		if len(tiles) == 1 {
+			tiles[0] = o.visibleArea()
+		}
+		for _, t := range tiles {
+			pdf.Rect(t.x, t.y, t.w, t.h, "D")
+		}
+	}
+	if option.Caption {
+		drawCaption(pdf, o, option)
+	}
+}
+
+func isTileMode(option BuildOption) bool {
+	return option.Tile || option.TileCols > 0
+}
+
+// tileAreas returns the areas to put the copies of the image in tile mode.
+// With --tile, the image is repeated in its physical size as many times as
+// it fits the area.  The physical size is computed from the size and the DPI
+// of the source image, not of the data to embed, which may be downsampled.
+// With --tile-count, the area is divided into the cells
+// and the image is fit to each cell.
+func tileAreas(o ImgOpt, a area, option BuildOption) []area {
+	var cols, rows int
+	var w, h, cellW, cellH float64
+	if option.TileCols > 0 {
+		cols, rows = option.TileCols, option.TileRows
+		cellW, cellH = a.w/float64(cols), a.h/float64(rows)
+		pw, ph := o.displaySize()
+		scale := math.Min(cellW/float64(pw), cellH/float64(ph))
+		w, h = scale*float64(pw), scale*float64(ph)
+	} else {
+		dpiX, dpiY := o.dpiX, o.dpiY
+		if dpiX == 0 || dpiY == 0 {
+			dpiX, dpiY = defaultImageDPI, defaultImageDPI
+		}
+		w, h = float64(o.pw)*25.4/dpiX, float64(o.ph)*25.4/dpiY
+		if o.angle == 90 || o.angle == 270 {
+			w, h = h, w
+		}
+		if w > a.w || h > a.h {
+			// Even one copy doesn't fit; scale it down.
+			scale := math.Min(a.w/w, a.h/h)
+			w, h = w*scale, h*scale
+		}
+		cols = int(math.Max(1, math.Floor(a.w/w)))
+		rows = int(math.Max(1, math.Floor(a.h/h)))
+		cellW, cellH = w, h
+	}
+
+	// Put the tiles at the center of the area.
+	x0 := a.x + (a.w-cellW*float64(cols))/2
+	y0 := a.y + (a.h-cellH*float64(rows))/2
+	tiles := make([]area, 0, cols*rows)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			tiles = append(tiles, area{
+				x: x0 + cellW*float64(c) + (cellW-w)/2,
+				y: y0 + cellH*float64(r) + (cellH-h)/2,
 				w: w,
 				h: h,
-				t: imgtype,
-				f: file,
+			})
+		}
+	}
+	return tiles
+}
+
+// attachmentName returns the name to attach the file as.  It's the base name
+// of the file, numbered like "image-2.png" if it's already used.
+func attachmentName(file string, used map[string]bool) string {
+	name := filepath.Base(file)
+	if isURL(file) {
+		name = urlBaseName(file)
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return name
+}
+
+// planPages returns the page number of each file, counting pages in the same
+// way as putPage() in renderPDF().  The pages start after the page "last".
+func planPages(files []string, resource *Resource, last int) []int {
+	pages := make([]int, len(files))
+	pageno := last
+	prev := ""
+	right := false
+	for i, f := range files {
+		if dir, ok := resource.chapters[f]; ok && dir != prev {
+			if prev != "" && resource.Option.Separator {
+				pageno++
 			}
-		}(file, &imgOpts[i])
+			prev = dir
+			right = false
+		}
+		if !right {
+			pageno++
+		}
+		right = resource.Option.Spread && !right
+		pages[i] = pageno
+	}
+	return pages
+}
+
+// countPages returns the number of pages of the PDF, assuming that all the
+// inputs are valid images.
+func countPages(resource *Resource) int {
+	option := resource.Option
+	n := 0
+	if option.CoverText != "" || option.CoverImage != "" {
+		n++
+	}
+	if option.TOC {
+		n += tocPageCount(len(resource.Infiles), option)
+	}
+	if pages := planPages(resource.Infiles, resource, n); len(pages) != 0 {
+		n = pages[len(pages)-1]
 	}
-	wg.Wait()
-	close(errChan)
+	return n
+}
 
-	if !resource.Option.ExcludeInvalidFiles {
-		for err := range errChan {
+func BuildPDF(resource Resource) (err error) {
+	err = validateResource(&resource)
+	defer resource.closeInputs()
+	if err != nil {
+		return err
+	}
+	if resource.outfileClaimed {
+		setPendingOutput(resource.Outfile)
+		defer func() {
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return errors.New("Error happened while extracting metadata.")
+				// Release the claimed output file name.
+				os.Remove(resource.Outfile)
+			}
+		}()
+	}
+	defer setPendingOutput("")
+
+	if resource.Option.Count {
+		fmt.Println(countPages(&resource))
+		return nil
+	}
+	if resource.Option.CacheFile != "" {
+		resource.cache = loadMetaCache(resource.Option.CacheFile)
+	}
+
+	var summary *buildSummary
+	var pdf *fpdf.Fpdf
+	var data []byte
+	if resource.Option.MaxOutputSize > 0 {
+		data, summary, err = renderPDFWithinSize(&resource)
+	} else {
+		pdf, summary, err = renderPDF(&resource)
+	}
+	if err != nil {
+		return err
+	}
+	if resource.Option.Manifest != "" {
+		if err := writeManifest(
+			resource.Option.Manifest, summary.manifest); err != nil {
+			return fmt.Errorf("Failed to write manifest: %w", err)
+		}
+	}
+	pendingOutput.Lock()
+	if pdf != nil {
+		err = pdf.OutputFileAndClose(resource.Outfile)
+	} else {
+		err = os.WriteFile(resource.Outfile, data, 0644)
+	}
+	if err == nil {
+		pendingOutput.file = ""
+	}
+	pendingOutput.Unlock()
+	if err != nil {
+		return err
+	}
+	fmt.Println(colorize(os.Stdout, colorGreen, "Successfully generated:"),
+		resource.Outfile)
+	if err := resource.cache.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save cache:", err)
+	}
+	if resource.Option.Summary {
+		summary.print(os.Stdout, resource.Outfile)
+	}
+	return nil
+}
+
+// renderPDFWithinSize renders the PDF lowering the JPEG quality until the
+// PDF gets smaller than the max output size.  The quality is searched by
+// bisection to keep the number of renderings small.  The images are loaded
+// only once, and only the images embedded in JPEG are encoded again for each
+// quality.
+func renderPDFWithinSize(resource *Resource) ([]byte, *buildSummary, error) {
+	images := []ImgOpt{}
+	err := loadImgOpts(resource, func(o ImgOpt) {
+		images = append(images, o)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decoded images to encode in JPEG, which are kept while searching.
+	decoded := make([]image.Image, len(images))
+	render := func(images []ImgOpt) ([]byte, *buildSummary, error) {
+		pdf, summary, err := layoutPDF(resource, func(put func(ImgOpt)) error {
+			for _, o := range images {
+				put(o)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		var buf bytes.Buffer
+		if err := pdf.Output(&buf); err != nil {
+			return nil, nil, err
+		}
+		return buf.Bytes(), summary, nil
+	}
+
+	maxSize := resource.Option.MaxOutputSize
+	data, summary, err := render(images)
+	if err != nil || int64(len(data)) <= maxSize {
+		return data, summary, err
+	}
+
+	lo, hi := 1, 95
+	if q := resource.Option.JPEGQuality; q > 0 && q <= hi {
+		hi = q - 1
+	}
+	var best []byte
+	var bestSummary *buildSummary
+	bestQuality := 0
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		reencoded, err := reencodeImages(resource, images, decoded, mid)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, s, err := render(reencoded)
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(d)) <= maxSize {
+			best, bestSummary, bestQuality = d, s, mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+			if int64(len(d)) < int64(len(data)) {
+				data, summary = d, s
 			}
 		}
 	}
+	if best == nil {
+		fmt.Println("Warning: The PDF can't be smaller than",
+			formatFileSize(maxSize)+".", "Generated one is",
+			formatFileSize(int64(len(data))))
+		return data, summary, nil
+	}
+	fmt.Println("JPEG quality is lowered to", bestQuality,
+		"to make the PDF smaller than", formatFileSize(maxSize))
+	return best, bestSummary, nil
+}
 
-	pdf := fpdf.New("P", "mm", "A4", "")
-	for _, o := range imgOpts {
-		if o.f == "" { // Skip errored file
+// reencodeImages returns the images whose lossy ones are encoded in JPEG of
+// the quality.  The images are decoded into decoded[i] on the first call and
+// reused later.
+func reencodeImages(resource *Resource, images []ImgOpt,
+	decoded []image.Image, quality int) ([]ImgOpt, error) {
+	result := make([]ImgOpt, len(images))
+	for i, o := range images {
+		result[i] = o
+		if !o.lossy {
 			continue
 		}
-		pdf.AddPage()
-		pdf.ImageOptions(o.f, o.x, o.y, o.w, o.h, false, fpdf.ImageOptions{
-			ImageType:             o.t,
-			ReadDpi:               true,
-			AllowNegativePosition: false,
-		}, 0, "")
+		if decoded[i] == nil {
+			src, err := resource.openInput(o.f)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", o.f, err)
+			}
+			decoded[i], _, err = transformImage(src, o, resource.Option)
+			src.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", o.f, err)
+			}
+		}
+		data, err := encodeImage(decoded[i], "jpeg", quality)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", o.f, err)
+		}
+		result[i].data, result[i].t = data, "jpeg"
 	}
-	if err := pdf.OutputFileAndClose(resource.Outfile); err != nil {
-		return err
+	return result, nil
+}
+
+// renderPDF lays out the pages of the PDF.  The returned document is not
+// written yet.
+func renderPDF(resource *Resource) (*fpdf.Fpdf, *buildSummary, error) {
+	return layoutPDF(resource, func(put func(ImgOpt)) error {
+		return loadImgOpts(resource, put)
+	})
+}
+
+// loadImgOpts loads the input images and calls put with each of them in input
+// order.  Invalid images are excluded with --exclude-invalid-files.
+// Otherwise, put is no longer called after an invalid image is found, and the
+// errors of all the invalid images are returned.
+func loadImgOpts(resource *Resource, put func(ImgOpt)) error {
+	type result struct {
+		opt ImgOpt
+		err error
+	}
+
+	// Extract metadata (and convert images if needed) concurrently, but keep
+	// at most "window" results in flight so that memory usage does not grow
+	// with the number of files.
+	// Results are consumed in input order to keep the page order.
+	window := runtime.NumCPU()
+	results := make([]chan result, len(resource.Infiles))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	sem := make(chan struct{}, window)
+	go func() {
+		for i, file := range resource.Infiles {
+			sem <- struct{}{}
+			go func(file string, dest chan<- result) {
+				o, err := loadImgOptWithRetry(resource, file)
+				dest <- result{opt: o, err: err}
+			}(file, results[i])
+		}
+	}()
+
+	// All the results are received even after an error so that no
+	// goroutine is left blocked.
+	errs := []error{}
+	for i, c := range results {
+		r := <-c
+		<-sem
+		if r.err != nil {
+			if resource.Option.ExcludeInvalidFiles {
+				fmt.Println(
+					"Error happens while extracting metadata:", r.err, "\n",
+					"    Excluded:", resource.Infiles[i])
+			} else {
+				errs = append(errs,
+					fmt.Errorf("%s: %w", resource.Infiles[i], r.err))
+			}
+			continue
+		}
+		if len(errs) != 0 {
+			// The PDF won't be written; just keep collecting errors.
+			continue
+		}
+		put(r.opt)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf(
+			"Error happened while extracting metadata:\n%w",
+			errors.Join(errs...))
 	}
-	fmt.Println("Successfully generated:", resource.Outfile)
 	return nil
 }
 
+// layoutPDF lays out the pages of the PDF.  load gives the images to put with
+// put.  It's called after the cover page, which may fail, is added so that
+// loading the images is never abandoned halfway.
+func layoutPDF(resource *Resource,
+	load func(put func(ImgOpt)) error) (*fpdf.Fpdf, *buildSummary, error) {
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		OrientationStr: "P",
+		UnitStr:        "mm",
+		Size: fpdf.SizeType{
+			Wd: resource.Option.PageWidth,
+			Ht: resource.Option.PageHeight,
+		},
+	})
+	pdf.SetAutoPageBreak(false, 0)
+	setHeaderFooter(pdf, resource.Option)
+	if resource.Option.CoverText != "" || resource.Option.CoverImage != "" {
+		if err := addCoverPage(pdf, resource.Option); err != nil {
+			return nil, nil, err
+		}
+	}
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	chapter := ""
+	// True when the next image is put on the right half of the current
+	// page in spread mode.
+	spreadRight := false
+	attachments := []fpdf.Attachment{}
+	attachmentNames := map[string]bool{}
+	summary := newBuildSummary()
+	putPage := func(o ImgOpt) {
+		dir, inChapter := resource.chapters[o.f]
+		newChapter := inChapter && dir != chapter
+		bookmarked := false
+		if newChapter && chapter != "" && resource.Option.Separator {
+			addSeparatorPage(pdf, dir, resource.Option)
+			if resource.Option.Bookmarks {
+				pdf.Bookmark(tr(dir), 0, 0)
+				bookmarked = true
+			}
+		}
+		if newChapter {
+			chapter = dir
+			spreadRight = false
+		}
+
+		if spreadRight {
+			o.fit(imageSlot(resource.Option, resource.Option.PageWidth,
+				resource.Option.PageHeight, true))
+			drawImage(pdf, o, resource.Option)
+		} else {
+			addImagePage(pdf, o, resource.Option)
+		}
+		spreadRight = resource.Option.Spread && !spreadRight
+		summary.add(o, pdf.PageNo())
+		if resource.Option.EmbedOriginals {
+			name := attachmentName(o.f, attachmentNames)
+			attachmentNames[name] = true
+			attachments = append(attachments, fpdf.Attachment{
+				Content:     o.original,
+				Filename:    name,
+				Description: o.f,
+			})
+		}
+		if !resource.Option.Bookmarks {
+			return
+		}
+		if newChapter && !bookmarked {
+			pdf.Bookmark(tr(dir), 0, 0)
+		}
+		level := 0
+		if inChapter {
+			level = 1
+		}
+		pdf.Bookmark(tr(filepath.Base(o.f)), level, 0)
+	}
+
+	pending := []ImgOpt{}
+	err := load(func(o ImgOpt) {
+		if resource.Option.TOC {
+			// Pages are added after the table of contents is made.
+			pending = append(pending, o)
+			return
+		}
+		putPage(o)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resource.Option.TOC {
+		titles := make([]string, len(pending))
+		for i, o := range pending {
+			titles[i] = o.f
+		}
+		pages := planPages(titles, resource,
+			pdf.PageNo()+tocPageCount(len(titles), resource.Option))
+		links := addTOCPages(pdf, titles, pages, resource.Option)
+		for i, o := range pending {
+			putPage(o)
+			pdf.SetLink(links[i], 0, -1)
+		}
+	}
+
+	if len(attachments) != 0 {
+		pdf.SetAttachments(attachments)
+	}
+	return pdf, summary, nil
+}
+
 func run() error {
 	r, err := parseArgs(os.Args[1:])
-	if err != nil {
+	if err == errExit {
+		return nil
+	} else if err != nil {
 		return err
 	}
+	handleInterrupt()
 	return BuildPDF(r)
 }
 
 func main() {
 	if err := run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, colorize(os.Stderr, colorRed, err.Error()))
 		os.Exit(1)
 	}
 }
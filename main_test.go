@@ -0,0 +1,710 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// writeImage writes a w x h image to the file in the format given by encode.
+func writeImage(t *testing.T, file string, w, h int,
+	encode func(f *os.File, img image.Image) error) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := encode(f, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodePNG(f *os.File, img image.Image) error { return png.Encode(f, img) }
+func encodeBMP(f *os.File, img image.Image) error { return bmp.Encode(f, img) }
+func encodeTIFF(f *os.File, img image.Image) error {
+	return tiff.Encode(f, img, nil)
+}
+
+// newTestResource returns a validated resource for the files.
+func newTestResource(t *testing.T, args ...string) Resource {
+	t.Helper()
+	args = append([]string{"files", "-o",
+		filepath.Join(t.TempDir(), "out.pdf")}, args...)
+	r, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateResource(&r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLoadImgOptTranscodesBMP(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.bmp")
+	writeImage(t, file, 40, 20, encodeBMP)
+
+	r := newTestResource(t, file)
+	o, err := loadImgOpt(&r, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.t != "png" || o.data == nil {
+		t.Fatalf("BMP is not transcoded: type %q, data %v", o.t, o.data != nil)
+	}
+	c, err := png.DecodeConfig(bytes.NewReader(o.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Width != 40 || c.Height != 20 {
+		t.Errorf("transcoded size: %dx%d", c.Width, c.Height)
+	}
+
+	r = newTestResource(t, "--no-transcode", file)
+	if _, err := loadImgOpt(&r, file); err == nil {
+		t.Error("BMP is accepted with --no-transcode")
+	}
+}
+
+// pngBytes returns a w x h PNG.  Noisy pixels keep it from compressing well.
+func pngBytes(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7919 % 251)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveEntriesRespectMaxFileSize(t *testing.T) {
+	small, large := pngBytes(t, 4, 4), pngBytes(t, 64, 64)
+	if len(small) >= 1024 || len(large) <= 1024 {
+		t.Fatalf("unexpected PNG sizes: %d, %d", len(small), len(large))
+	}
+	entries := []struct {
+		name string
+		data []byte
+	}{{"small.png", small}, {"large.png", large}}
+
+	dir := t.TempDir()
+	zipFile, tarFile := filepath.Join(dir, "a.zip"), filepath.Join(dir, "a.tar")
+	var zbuf, tbuf bytes.Buffer
+	zw, tw := zip.NewWriter(&zbuf), tar.NewWriter(&tbuf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+		tw.WriteHeader(&tar.Header{
+			Name: e.name, Mode: 0644, Size: int64(len(e.data)),
+			Typeflag: tar.TypeReg})
+		tw.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(zipFile, zbuf.Bytes(), 0644)
+	os.WriteFile(tarFile, tbuf.Bytes(), 0644)
+
+	for _, archive := range []string{zipFile, tarFile} {
+		r := newTestResource(t, "--max-file-size", "1KB", archive)
+		want := []string{filepath.Join(archive, "small.png")}
+		if !reflect.DeepEqual(r.Infiles, want) {
+			t.Errorf("%s: got %v, want %v", archive, r.Infiles, want)
+		}
+	}
+}
+
+func TestFetchURLRespectsMaxFileSize(t *testing.T) {
+	data := pngBytes(t, 64, 64)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/chunked" {
+				// Flushing before writing drops Content-Length.
+				w.(http.Flusher).Flush()
+			}
+			w.Write(data)
+		}))
+	defer srv.Close()
+
+	for _, path := range []string{"/sized", "/chunked"} {
+		option := BuildOption{MaxFileSize: 1024}
+		if _, err := fetchURL(srv.URL+path, option); !errors.Is(
+			err, errLargeFile) {
+			t.Errorf("%s: got %v, want errLargeFile", path, err)
+		}
+		option.MaxFileSize = int64(len(data))
+		got, err := fetchURL(srv.URL+path, option)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: content within the limit is not fetched: %v",
+				path, err)
+		}
+	}
+}
+
+func TestRenderPDFReportsUnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	good, lost := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writeImage(t, good, 10, 10, encodePNG)
+	writeImage(t, lost, 10, 10, encodePNG)
+
+	r := newTestResource(t, good, lost)
+	// The file disappears after validation, e.g. removed by another process.
+	if err := os.Remove(lost); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadImgOpt(&r, lost); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("loadImgOpt: got %v, want fs.ErrNotExist", err)
+	}
+	_, _, err := renderPDF(&r)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("renderPDF: got %v, want fs.ErrNotExist", err)
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], lost+": ") {
+		t.Errorf("not a single error for the file: %q", err)
+	}
+}
+
+// zeroWidthImages returns images whose headers report a width of 0.
+func zeroWidthImages(t *testing.T) map[string][]byte {
+	t.Helper()
+	p := pngBytes(t, 10, 10)
+	// IHDR: length(4) type(4) width(4) height(4) ... crc(4)
+	binary.BigEndian.PutUint32(p[16:], 0)
+	binary.BigEndian.PutUint32(p[29:], crc32.ChecksumIEEE(p[12:29]))
+
+	var g bytes.Buffer
+	img := image.NewPaletted(image.Rect(0, 0, 10, 10),
+		color.Palette{color.Black})
+	if err := gif.Encode(&g, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The logical screen width follows the 6-byte signature.
+	binary.LittleEndian.PutUint16(g.Bytes()[6:], 0)
+	return map[string][]byte{"zero.png": p, "zero.gif": g.Bytes()}
+}
+
+func TestZeroDimensionImageIsInvalid(t *testing.T) {
+	for name, data := range zeroWidthImages(t) {
+		dir := t.TempDir()
+		good, bad := filepath.Join(dir, "a.png"), filepath.Join(dir, name)
+		writeImage(t, good, 10, 10, encodePNG)
+		if err := os.WriteFile(bad, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newTestResource(t, good, bad)
+		if _, err := loadImgOpt(&r, bad); err == nil {
+			t.Errorf("%s: loadImgOpt accepts the image", name)
+		}
+		if _, _, err := renderPDF(&r); err == nil {
+			t.Errorf("%s: renderPDF accepts the image", name)
+		}
+
+		r = newTestResource(t, "--exclude-invalid-files", good, bad)
+		_, summary, err := renderPDF(&r)
+		if err != nil {
+			t.Fatalf("%s: with --exclude-invalid-files: %v", name, err)
+		}
+		if summary.images != 1 {
+			t.Errorf("%s: got %d images, want 1", name, summary.images)
+		}
+	}
+}
+
+func TestFitWideImageOnPortraitPage(t *testing.T) {
+	page := area{w: 200, h: 300}
+	tests := []struct {
+		name   string
+		crop   bool
+		margin float64
+		align  string
+		angle  int
+		want   area // x, y, w and h of the image
+		clip   area
+	}{
+		{"letterbox", false, 0, "", 0,
+			area{0, 125, 200, 50}, area{}},
+		{"crop", true, 0, "", 0,
+			area{-500, 0, 1200, 300}, area{0, 0, 200, 300}},
+		{"crop with margin", true, 10, "", 0,
+			area{-460, 10, 1120, 280}, area{10, 10, 180, 280}},
+		{"crop aligned left", true, 0, "left", 0,
+			area{0, 0, 1200, 300}, area{0, 0, 200, 300}},
+		{"crop rotated", true, 0, "", 90,
+			area{0, -250, 200, 800}, area{0, 0, 200, 300}},
+	}
+	near := func(a, b area) bool {
+		const eps = 1e-9
+		return math.Abs(a.x-b.x) < eps && math.Abs(a.y-b.y) < eps &&
+			math.Abs(a.w-b.w) < eps && math.Abs(a.h-b.h) < eps
+	}
+	for _, tt := range tests {
+		o := ImgOpt{pw: 400, ph: 100, crop: tt.crop, margin: tt.margin,
+			align: tt.align, angle: tt.angle}
+		o.fit(page)
+		if got := (area{o.x, o.y, o.w, o.h}); !near(got, tt.want) {
+			t.Errorf("%s: image %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !near(o.clip, tt.clip) {
+			t.Errorf("%s: clip %+v, want %+v", tt.name, o.clip, tt.clip)
+		}
+	}
+}
+
+func TestScanDirSkipsHiddenFiles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{".DS_Store", "IMAGE.JPG", "Thumbs.db", "b.png"}
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		option BuildOption
+		want   []string
+	}{
+		{BuildOption{}, []string{"IMAGE.JPG", "b.png"}},
+		{BuildOption{IncludeHidden: true}, names},
+	}
+	for _, tt := range tests {
+		files, err := scanDir(dir, tt.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{}
+		for _, name := range tt.want {
+			want = append(want, filepath.Join(dir, name))
+		}
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("IncludeHidden=%v: got %v, want %v",
+				tt.option.IncludeHidden, files, want)
+		}
+	}
+}
+
+// withPHYs inserts a pHYs chunk recording the resolution (in pixels per
+// metre) just after the IHDR chunk of the PNG.
+func withPHYs(data []byte, ppmX, ppmY uint32) []byte {
+	chunk := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(chunk, 9)
+	copy(chunk[4:], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:], ppmX)
+	binary.BigEndian.PutUint32(chunk[12:], ppmY)
+	chunk[16] = 1 // metre
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+	// signature(8) + IHDR(4+4+13+4)
+	const ihdrEnd = 33
+	result := append([]byte{}, data[:ihdrEnd]...)
+	result = append(result, chunk...)
+	return append(result, data[ihdrEnd:]...)
+}
+
+func TestPagePerImageSizesEachPage(t *testing.T) {
+	dir := t.TempDir()
+	images := []struct {
+		name  string
+		data  []byte
+		pageW float64
+		pageH float64
+	}{
+		// Images without pHYs are regarded as 72 DPI.
+		{"a.png", pngBytes(t, 144, 72), 50.8, 25.4},
+		{"b.png", pngBytes(t, 72, 144), 25.4, 50.8},
+		// 11811 pixels per metre is about 300 DPI.
+		{"c.png", withPHYs(pngBytes(t, 144, 72), 11811, 11811),
+			144 * 25.4 / (11811 * 0.0254), 72 * 25.4 / (11811 * 0.0254)},
+	}
+	files := []string{}
+	for _, img := range images {
+		file := filepath.Join(dir, img.name)
+		if err := os.WriteFile(file, img.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	r := newTestResource(t, append([]string{"--page-per-image"}, files...)...)
+	for i, img := range images {
+		o, err := loadImgOpt(&r, files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(o.pageW-img.pageW) > 1e-9 ||
+			math.Abs(o.pageH-img.pageH) > 1e-9 {
+			t.Errorf("%s: page %gx%g, want %gx%g",
+				img.name, o.pageW, o.pageH, img.pageW, img.pageH)
+		}
+	}
+}
+
+func TestTileAreasUseSourceDPI(t *testing.T) {
+	a := area{w: 100, h: 100}
+	option := BuildOption{Tile: true}
+	tests := []struct {
+		name       string
+		o          ImgOpt
+		w, h       float64
+		cols, rows int
+	}{
+		{"no DPI", ImgOpt{pw: 72, ph: 36}, 25.4, 12.7, 3, 7},
+		{"144 DPI", ImgOpt{pw: 72, ph: 36, dpiX: 144, dpiY: 144},
+			12.7, 6.35, 7, 15},
+		{"rotated", ImgOpt{pw: 72, ph: 36, angle: 90}, 12.7, 25.4, 7, 3},
+	}
+	for _, tt := range tests {
+		tiles := tileAreas(tt.o, a, option)
+		if len(tiles) != tt.cols*tt.rows {
+			t.Errorf("%s: got %d tiles, want %dx%d",
+				tt.name, len(tiles), tt.cols, tt.rows)
+			continue
+		}
+		if math.Abs(tiles[0].w-tt.w) > 1e-9 ||
+			math.Abs(tiles[0].h-tt.h) > 1e-9 {
+			t.Errorf("%s: tile %gx%g, want %gx%g",
+				tt.name, tiles[0].w, tiles[0].h, tt.w, tt.h)
+		}
+	}
+}
+
+func TestRespectDPIUsesEachAxis(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.png")
+	// 100x100 pixels at 100 x 200 DPI, i.e. 1 x 0.5 inch.
+	data := withPHYs(pngBytes(t, 100, 100), 3937, 7874)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"--respect-dpi"},
+		{"--page-per-image"},
+	} {
+		r := newTestResource(t, append(args, file)...)
+		o, err := loadImgOpt(&r, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantW, wantH := 100/(3937*0.0254)*25.4, 100/(7874*0.0254)*25.4
+		if math.Abs(o.w-wantW) > 1e-9 || math.Abs(o.h-wantH) > 1e-9 {
+			t.Errorf("%v: image %gx%g, want %gx%g",
+				args, o.w, o.h, wantW, wantH)
+		}
+	}
+}
+
+func TestOrderFileClearsChapters(t *testing.T) {
+	dir := t.TempDir()
+	dirs := []string{filepath.Join(dir, "x"), filepath.Join(dir, "y")}
+	for _, d := range dirs {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeImage(t, filepath.Join(d, "a.png"), 10, 10, encodePNG)
+	}
+	order := filepath.Join(dir, "order.txt")
+	if err := os.WriteFile(order, []byte("2\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{nil, {"--order", order}} {
+		args = append(append([]string{"dirs", "-o",
+			filepath.Join(dir, "out.pdf")}, args...), dirs...)
+		r, err := parseArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateResource(&r); err != nil {
+			t.Fatal(err)
+		}
+		want := len(r.Infiles)
+		if r.Option.OrderFile != "" {
+			want = 0
+		}
+		if len(r.chapters) != want {
+			t.Errorf("%v: got %d chapter entries, want %d",
+				args, len(r.chapters), want)
+		}
+	}
+}
+
+func TestSummaryCountsRotatedOrientation(t *testing.T) {
+	s := newBuildSummary()
+	s.add(ImgOpt{pw: 40, ph: 20}, 1)
+	s.add(ImgOpt{pw: 40, ph: 20, angle: 90}, 2)
+	s.add(ImgOpt{pw: 40, ph: 20, angle: 180}, 3)
+	if s.landscape != 2 || s.portrait != 1 {
+		t.Errorf("landscape %d, portrait %d; want 2, 1",
+			s.landscape, s.portrait)
+	}
+}
+
+func TestConfigFlagIsNotTakenFromFlagValues(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.png")
+	writeImage(t, file, 10, 10, encodePNG)
+	config := filepath.Join(dir, "config.toml")
+	err := os.WriteFile(config, []byte("footer = \"config\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", "")
+
+	// "--config" here is the header text, not the flag.
+	r, err := parseArgs(
+		[]string{"files", "--header", "--config", config, file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Option.Header != "--config" || r.Option.Footer != "" {
+		t.Errorf("the header text is taken as --config: %q, %q",
+			r.Option.Header, r.Option.Footer)
+	}
+
+	r, err = parseArgs([]string{"files", "--config", config, file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Option.Footer != "config" {
+		t.Errorf("the config file is not read: footer %q", r.Option.Footer)
+	}
+}
+
+func TestEnvFalseOverridesConfigTrue(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.toml")
+	content := "overwrite-pdf = true\ncaption = true\n"
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", config)
+	t.Setenv(envPrefix+"OVERWRITE", "false")
+	t.Setenv(envPrefix+"CAPTION", "0")
+
+	r, err := parseArgs([]string{"files", "a.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Option.OverwritePDF || r.Option.Caption {
+		t.Errorf("false in env doesn't override config: overwrite %v, "+
+			"caption %v", r.Option.OverwritePDF, r.Option.Caption)
+	}
+
+	// The command line still enables the flag.
+	r, err = parseArgs([]string{"files", "--caption", "a.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Option.Caption {
+		t.Error("the command line flag is overridden by env")
+	}
+}
+
+func TestFlagSpecsAreParsed(t *testing.T) {
+	t.Setenv(envPrefix+"CONFIG", "")
+	for _, f := range flagSpecs {
+		if f.hasValue() {
+			continue
+		}
+		r, err := parseArgs([]string{"files", f.name, "a.png"})
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+		} else if !reflect.DeepEqual(r.Infiles, []string{"a.png"}) {
+			t.Errorf("%s is not handled by parseArgs", f.name)
+		}
+	}
+}
+
+func TestImageNameDistinguishesConvertedData(t *testing.T) {
+	o := ImgOpt{f: "a.png"}
+	if imageName(o) != "a.png" {
+		t.Errorf("a file is registered as %q", imageName(o))
+	}
+	gray, trimmed := o, o
+	gray.data, trimmed.data = []byte("gray"), []byte("trimmed")
+	names := map[string]bool{
+		imageName(o): true, imageName(gray): true, imageName(trimmed): true}
+	if len(names) != 3 {
+		t.Errorf("names collide: %v", names)
+	}
+	again := gray
+	again.data = []byte("gray")
+	if imageName(again) != imageName(gray) {
+		t.Error("the same data is registered twice")
+	}
+}
+
+func TestSummaryCountsSpreadPagesOnce(t *testing.T) {
+	s := newBuildSummary()
+	for _, page := range []int{1, 1, 2, 2, 3} {
+		s.add(ImgOpt{pw: 10, ph: 10}, page)
+	}
+	if s.images != 5 || s.pages != 3 {
+		t.Errorf("images %d, pages %d; want 5, 3", s.images, s.pages)
+	}
+}
+
+func TestReencodeImagesOnlyReencodesLossyImages(t *testing.T) {
+	dir := t.TempDir()
+	jpgFile := filepath.Join(dir, "a.jpg")
+	pngFile := filepath.Join(dir, "b.png")
+	img, _, err := image.Decode(bytes.NewReader(pngBytes(t, 64, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeImage(img, "jpeg", 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jpgFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeImage(t, pngFile, 64, 64, encodePNG)
+
+	r := newTestResource(t, "--max-output-size", "1KB", jpgFile, pngFile)
+	images := []ImgOpt{}
+	if err := loadImgOpts(&r, func(o ImgOpt) {
+		images = append(images, o)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := make([]image.Image, len(images))
+	high, err := reencodeImages(&r, images, decoded, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded[0] == nil || decoded[1] != nil {
+		t.Fatal("only the JPEG image should be decoded")
+	}
+	low, err := reencodeImages(&r, images, decoded, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if high[0].t != "jpeg" || len(low[0].data) >= len(high[0].data) {
+		t.Errorf("JPEG is not reencoded: %d bytes at 90, %d bytes at 10",
+			len(high[0].data), len(low[0].data))
+	}
+	if low[1].data != nil || images[0].data != nil {
+		t.Error("images which are not lossy or loaded are modified")
+	}
+}
+
+func TestExtraImagesAreTranscoded(t *testing.T) {
+	dir := t.TempDir()
+	page, logo := filepath.Join(dir, "a.png"), filepath.Join(dir, "logo.bmp")
+	writeImage(t, page, 10, 10, encodePNG)
+	writeImage(t, logo, 40, 20, encodeBMP)
+
+	o, err := loadExtraImage(logo, BuildOption{Grayscale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.t != "png" || o.data == nil {
+		t.Fatalf("BMP is not transcoded: type %q", o.t)
+	}
+	if img, err := png.Decode(bytes.NewReader(o.data)); err != nil {
+		t.Fatal(err)
+	} else if _, gray := img.(*image.Gray); gray {
+		t.Error("options for the pages are applied")
+	}
+
+	r := newTestResource(t, "--watermark-image", logo, "--cover-image", logo,
+		page)
+	if _, _, err := renderPDF(&r); err != nil {
+		t.Error(err)
+	}
+
+	args := []string{"files", "--no-transcode", "--watermark-image", logo,
+		"-o", filepath.Join(dir, "out.pdf"), page}
+	r, err = parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateResource(&r)
+	if err == nil || !strings.Contains(err.Error(), logo) {
+		t.Errorf("BMP is accepted with --no-transcode: %v", err)
+	}
+}
+
+func TestMissingCoverImageIsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	page, cover := filepath.Join(dir, "a.png"), filepath.Join(dir, "no.png")
+	writeImage(t, page, 10, 10, encodePNG)
+
+	r, err := parseArgs([]string{"files", "--cover-image", cover,
+		"-o", filepath.Join(dir, "out.pdf"), page})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateResource(&r)
+	if !errors.Is(err, fs.ErrNotExist) ||
+		!strings.Contains(err.Error(), cover) {
+		t.Errorf("got %v, want an error for %s", err, cover)
+	}
+}
+
+func TestTIFFIsTranscoded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.tiff")
+	writeImage(t, file, 40, 20, encodeTIFF)
+
+	r := newTestResource(t, file)
+	o, err := loadImgOpt(&r, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.t != "png" || o.data == nil {
+		t.Fatalf("TIFF is not transcoded: type %q", o.t)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countTIFFPages(bytes.NewReader(data)); n != 1 {
+		t.Errorf("single-page TIFF: got %d pages", n)
+	}
+	// Header, and two empty IFDs at 8 and 14; the second one is the last.
+	multi := []byte("II*\x00\x08\x00\x00\x00" +
+		"\x00\x00\x0e\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00")
+	if n := countTIFFPages(bytes.NewReader(multi)); n != 2 {
+		t.Errorf("two-page TIFF: got %d pages", n)
+	}
+	// The IFD points to itself.
+	loop := []byte("II*\x00\x08\x00\x00\x00" + "\x00\x00\x08\x00\x00\x00")
+	if n := countTIFFPages(bytes.NewReader(loop)); n != 1 {
+		t.Errorf("looping TIFF: got %d pages", n)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifestEntry records an image page for --manifest.
+type manifestEntry struct {
+	Page        int     `json:"page"`
+	Source      string  `json:"source"`
+	Type        string  `json:"type"`
+	PixelWidth  int     `json:"pixelWidth"`
+	PixelHeight int     `json:"pixelHeight"`
+	DPI         float64 `json:"dpi"` // 0 when the image doesn't record it
+	WidthMM     float64 `json:"widthMM"`
+	HeightMM    float64 `json:"heightMM"`
+}
+
+func newManifestEntry(o ImgOpt, page int) manifestEntry {
+	v := o.visibleArea()
+	return manifestEntry{
+		Page:        page,
+		Source:      o.f,
+		Type:        o.t,
+		PixelWidth:  o.pw,
+		PixelHeight: o.ph,
+		DPI:         o.dpiX,
+		WidthMM:     v.w,
+		HeightMM:    v.h,
+	}
+}
+
+// writeManifest writes the entries to the file in JSON if the file name ends
+// with ".json", or in CSV otherwise.
+func writeManifest(file string, entries []manifestEntry) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		e := json.NewEncoder(f)
+		e.SetIndent("", "  ")
+		if err := e.Encode(entries); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{
+		"page", "source", "type", "pixel_width", "pixel_height", "dpi",
+		"width_mm", "height_mm",
+	})
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	for _, e := range entries {
+		dpi := ""
+		if e.DPI > 0 {
+			dpi = format(e.DPI)
+		}
+		w.Write([]string{
+			strconv.Itoa(e.Page), e.Source, e.Type, strconv.Itoa(e.PixelWidth),
+			strconv.Itoa(e.PixelHeight), dpi, format(e.WidthMM),
+			format(e.HeightMM),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
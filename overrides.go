@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LayoutOverride is the layout of a file given by the overrides file, which
+// takes precedence over the global options.  The overrides file is a JSON
+// object whose keys are file paths or base names, e.g.:
+//
+//	{
+//	  "cover.jpg": {"fit": "crop"},
+//	  "scan003.jpg": {"align": "top", "margin": 10}
+//	}
+//
+// fit is "contain" or "crop" (as --crop), align is one of center, top,
+// bottom, left, right, top-left, top-right, bottom-left and bottom-right,
+// and margin is the space around the image in mm.
+type LayoutOverride struct {
+	Fit    string   `json:"fit"`
+	Align  string   `json:"align"`
+	Margin *float64 `json:"margin"`
+}
+
+var alignments = []string{
+	"center", "top", "bottom", "left", "right",
+	"top-left", "top-right", "bottom-left", "bottom-right",
+}
+
+// loadOverrides reads the overrides file.
+func loadOverrides(file string) (map[string]LayoutOverride, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	overrides := map[string]LayoutOverride{}
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, fmt.Errorf("Invalid overrides file: %s: %w", file, err)
+	}
+	for name, ov := range overrides {
+		invalid := func(what string) error {
+			return errors.New(
+				"Invalid " + what + " in overrides file: " + name)
+		}
+		if ov.Fit != "" && ov.Fit != "contain" && ov.Fit != "crop" {
+			return nil, invalid("fit")
+		}
+		if ov.Align != "" && !hasInStrings(alignments, ov.Align) {
+			return nil, invalid("align")
+		}
+		if ov.Margin != nil && *ov.Margin < 0 {
+			return nil, invalid("margin")
+		}
+	}
+	return overrides, nil
+}
+
+// applyOverride sets the layout of the file given by the overrides file to
+// the image.  It doesn't update the placement.
+func applyOverride(o *ImgOpt, file string, option BuildOption) {
+	ov, ok := option.Overrides[file]
+	if !ok {
+		ov, ok = option.Overrides[filepath.Base(file)]
+	}
+	if !ok {
+		return
+	}
+	if ov.Fit != "" {
+		o.crop = ov.Fit == "crop"
+	}
+	o.align = ov.Align
+	if ov.Margin != nil {
+		o.margin = *ov.Margin
+	}
+}
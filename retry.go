@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The wait before the first retry.  It's doubled on every retry.
+const retryBackoff = 200 * time.Millisecond
+
+// isTransientError reports whether the error may go away by trying again,
+// e.g. I/O timeouts on a network mount.
+func isTransientError(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// loadImgOptWithRetry is loadImgOpt which retries up to --retries times on
+// transient errors.  With retries, the content of a file is read here so
+// that embedding it doesn't read the file again.
+func loadImgOptWithRetry(resource *Resource, file string) (ImgOpt, error) {
+	load := func() (ImgOpt, error) {
+		o, err := loadImgOpt(resource, file)
+		if err != nil || resource.Option.Retries == 0 || o.data != nil {
+			return o, err
+		}
+		src, err := resource.openInput(file)
+		if err != nil {
+			return ImgOpt{}, err
+		}
+		defer src.Close()
+		o.data, err = io.ReadAll(src)
+		return o, err
+	}
+
+	o, err := load()
+	backoff := retryBackoff
+	for n := 1; n <= resource.Option.Retries && err != nil; n++ {
+		if !isTransientError(err) {
+			break
+		}
+		logVerbose(resource.Option, "Retrying (%d/%d) %s: %v\n",
+			n, resource.Option.Retries, file, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		o, err = load()
+	}
+	return o, err
+}
+
+// logVerbose prints the message to stderr with --verbose.
+func logVerbose(option BuildOption, format string, a ...any) {
+	if option.Verbose {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
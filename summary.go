@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// buildSummary collects statistics of the placed images for --summary, and
+// the records of them for --manifest.
+type buildSummary struct {
+	images int
+	// Number of pages with images.  Pages may have two images with --spread.
+	pages     int
+	lastPage  int
+	portrait  int
+	landscape int
+	square    int
+
+	// Number of images in each size class; see sizeClasses.
+	sizes []int
+
+	manifest []manifestEntry
+}
+
+// Size classes of images in megapixels.  Each entry is the upper bound
+// (exclusive) of the class, and the last class has no upper bound.
+var sizeClasses = []struct {
+	label string
+	limit float64
+}{
+	{"< 1MP", 1},
+	{"1-4MP", 4},
+	{"4-12MP", 12},
+	{">= 12MP", 0},
+}
+
+func newBuildSummary() *buildSummary {
+	return &buildSummary{sizes: make([]int, len(sizeClasses))}
+}
+
+// add records the image put on the page.
+func (s *buildSummary) add(o ImgOpt, page int) {
+	if s.images == 0 || page != s.lastPage {
+		s.pages++
+		s.lastPage = page
+	}
+	s.images++
+	s.manifest = append(s.manifest, newManifestEntry(o, page))
+	// The orientation is of the image as shown, i.e. after rotation.
+	if w, h := o.displaySize(); w > h {
+		s.landscape++
+	} else if w < h {
+		s.portrait++
+	} else {
+		s.square++
+	}
+	mp := float64(o.pw) * float64(o.ph) / 1e6
+	for i, c := range sizeClasses {
+		if c.limit == 0 || mp < c.limit {
+			s.sizes[i]++
+			break
+		}
+	}
+}
+
+func (s *buildSummary) print(w io.Writer, outfile string) {
+	fmt.Fprintln(w, "Summary:")
+	fmt.Fprintln(w, "    Images:", s.images)
+	fmt.Fprintln(w, "    Image pages:", s.pages)
+	fmt.Fprintf(w, "    Portrait: %d, Landscape: %d, Square: %d\n",
+		s.portrait, s.landscape, s.square)
+	fmt.Fprint(w, "    Image sizes:")
+	for i, c := range sizeClasses {
+		fmt.Fprintf(w, " %s: %d", c.label, s.sizes[i])
+		if i != len(sizeClasses)-1 {
+			fmt.Fprint(w, ",")
+		}
+	}
+	fmt.Fprintln(w)
+	if info, err := os.Stat(outfile); err == nil {
+		fmt.Fprintln(w, "    Output file size:", formatFileSize(info.Size()))
+	}
+}
+
+// formatFileSize formats the size in bytes in a human readable form.
+func formatFileSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	v := float64(size)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const (
+	tocMargin      = float64(20) // in mm
+	tocTitleHeight = float64(15) // in mm
+	tocLineHeight  = float64(7)  // in mm
+	tocTitleSize   = float64(18) // in pt
+	tocEntrySize   = float64(11) // in pt
+)
+
+// tocPageCount returns the number of pages needed for the table of contents
+// with n entries.
+func tocPageCount(n int, option BuildOption) int {
+	first, rest := tocCapacity(option)
+	if n <= first {
+		return 1
+	}
+	return 1 + (n-first+rest-1)/rest
+}
+
+// tocCapacity returns how many entries can be put on the first page of the
+// table of contents, which has the title, and on the rest pages.
+func tocCapacity(option BuildOption) (int, int) {
+	height := option.PageHeight - tocMargin*2
+	first := int((height - tocTitleHeight) / tocLineHeight)
+	rest := int(height / tocLineHeight)
+	// The page is too small; give up on the fine layout.
+	if first < 1 {
+		first = 1
+	}
+	if rest < 1 {
+		rest = 1
+	}
+	return first, rest
+}
+
+// addTOCPages adds the table of contents pages which list the titles with
+// their page numbers.  Returns the links which should be set to the page of
+// each entry.
+func addTOCPages(
+	pdf *fpdf.Fpdf, titles []string, pages []int, option BuildOption) []int {
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	width := option.PageWidth - tocMargin*2
+
+	links := make([]int, len(titles))
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", tocTitleSize)
+	pdf.SetXY(tocMargin, tocMargin)
+	pdf.CellFormat(width, tocTitleHeight, "Contents", "", 0, "L",
+		false, 0, "")
+	y := tocMargin + tocTitleHeight
+	capacity, rest := tocCapacity(option)
+	for i, title := range titles {
+		if capacity == 0 {
+			pdf.AddPage()
+			y = tocMargin
+			capacity = rest
+		}
+		capacity--
+		links[i] = pdf.AddLink()
+		pageno := strconv.Itoa(pages[i])
+
+		pdf.SetFont("Helvetica", "", tocEntrySize)
+		numWidth := pdf.GetStringWidth("00000")
+		title = truncateText(pdf, tr(title), width-numWidth)
+		pdf.SetXY(tocMargin, y)
+		pdf.CellFormat(width-numWidth, tocLineHeight, title, "", 0, "L",
+			false, links[i], "")
+		pdf.CellFormat(numWidth, tocLineHeight, pageno, "", 0, "R",
+			false, links[i], "")
+		y += tocLineHeight
+	}
+	return links
+}
+
+// truncateText shortens the text with "..." so that it fits the width.
+func truncateText(pdf *fpdf.Fpdf, text string, width float64) string {
+	if pdf.GetStringWidth(text) <= width {
+		return text
+	}
+	for len(text) > 0 && pdf.GetStringWidth(text+"...") > width {
+		text = text[:len(text)-1]
+	}
+	return text + "..."
+}
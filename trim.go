@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// trimBounds detects the uniform border of the image and returns the bounds
+// of the image without it.  The color of the border is the one of the
+// top-left pixel, and pixels whose channels differ from it by at most
+// tolerance (0-255) are regarded as the border.  The bounds of the whole
+// image is returned when there's no border or the image is uniform.
+func trimBounds(img image.Image, tolerance int) image.Rectangle {
+	b := img.Bounds()
+	ref := img.At(b.Min.X, b.Min.Y)
+	isBorder := func(c color.Color) bool {
+		r1, g1, b1, a1 := ref.RGBA()
+		r2, g2, b2, a2 := c.RGBA()
+		tol := uint32(tolerance) * 0x101
+		diff := func(x, y uint32) uint32 {
+			if x > y {
+				return x - y
+			}
+			return y - x
+		}
+		return diff(r1, r2) <= tol && diff(g1, g2) <= tol &&
+			diff(b1, b2) <= tol && diff(a1, a2) <= tol
+	}
+	rowIsBorder := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !isBorder(img.At(x, y)) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !isBorder(img.At(x, y)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := b
+	for r.Min.Y < r.Max.Y && rowIsBorder(r.Min.Y, r.Min.X, r.Max.X) {
+		r.Min.Y++
+	}
+	if r.Min.Y == r.Max.Y {
+		// Uniform image.
+		return b
+	}
+	for rowIsBorder(r.Max.Y-1, r.Min.X, r.Max.X) {
+		r.Max.Y--
+	}
+	for colIsBorder(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for colIsBorder(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// cropImage returns the part of the image in r.
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// isURL reports whether the target is an HTTP(S) URL.
+func isURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") &&
+		u.Host != ""
+}
+
+// urlBaseName returns the last element of the path of the URL.
+func urlBaseName(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "download"
+	}
+	if base := path.Base(u.Path); base != "/" && base != "." {
+		return base
+	}
+	return u.Hostname()
+}
+
+// errLargeFile is returned by fetchURL when the content exceeds the limit
+// specified by --max-file-size.
+var errLargeFile = errors.New("file is larger than the limit")
+
+// fetchURL downloads the content of the URL.  The download is stopped as soon
+// as the content turns out to be larger than the --max-file-size limit.
+func fetchURL(target string, option BuildOption) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "gachanco")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	limit := option.MaxFileSize
+	if limit <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+	if isLargeFile(target, resp.ContentLength, option) {
+		return nil, errLargeFile
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		fmt.Println(
+			"File is larger than the limit: over", limit, "bytes\n",
+			"    Excluded:", target)
+		return nil, errLargeFile
+	}
+	return data, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// Build information.  Set at link time like:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.commit=..."
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// getVersion returns the version string shown by --version.  The information
+// not given at link time is taken from the build info embedded by the Go
+// toolchain.
+func getVersion() string {
+	v, c, d := version, commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && c == "" {
+				c = s.Value
+			} else if s.Key == "vcs.time" && d == "" {
+				d = s.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+
+	lines := []string{"gachanco " + v}
+	if c != "" {
+		lines = append(lines, "commit: "+c)
+	}
+	if d != "" {
+		lines = append(lines, "built at: "+d)
+	}
+	return strings.Join(lines, "\n")
+}